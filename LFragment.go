@@ -3,7 +3,6 @@ package main
 import (
 	"fmt"
 
-	"github.com/charmbracelet/log"
 	lua "github.com/yuin/gopher-lua"
 )
 
@@ -81,6 +80,8 @@ var fragmentMethods = map[string]lua.LGFunction{
 	"addBuilders":   fragmentBuilders,
 	"builders":      fragmentGetBuilders,
 	"setTemplate":   fragmentSetTemplate,
+	"setCacheable":  fragmentSetCacheable,
+	"expects":       fragmentExpects,
 }
 
 func fragmentIndex(L *lua.LState) int {
@@ -118,6 +119,7 @@ func fragmentGetMeta(L *lua.LState) int {
 func fragmentGetSharedMeta(L *lua.LState) int {
 	f := checkFragment(L)
 	key := L.CheckString(2)
+	f.readSharedMeta(key)
 	value := getNestedValue(f.SharedMeta, key)
 	L.Push(value.luaType(L))
 	return 1
@@ -127,7 +129,7 @@ func fragmentMergeMeta(L *lua.LState) int {
 	// Mergemeta is interesting, it takes in a table and merges it with the current metadata, overwriting existing keys, and creating non-existent ones
 	f := checkFragment(L)
 	if f.Fragment.EvalState != PENDING {
-		log.Warn("Merging metadata on a partially evaluated fragment will not trigger re-evaluation of previous computations.", "fragment", f.Fragment.Name)
+		f.Fragment.Render.ReportWarning(fmt.Errorf("%s: merging metadata on a partially evaluated fragment will not trigger re-evaluation of previous computations", f.Fragment.Name))
 	}
 
 	if L.GetTop() < 2 {
@@ -142,6 +144,7 @@ func fragmentMergeMeta(L *lua.LState) int {
 	gt := NewCoreTableL(table)
 
 	f.LocalMeta.mergeMut(gt)
+	f.Fragment.metaTracer().set(f.Fragment, "local", f.LocalMeta, gt, "setLocalMeta", currentLuaLine(L))
 
 	return 0
 }
@@ -160,6 +163,7 @@ func fragmentMergeSharedMeta(L *lua.LState) int {
 	gt := NewCoreTableL(table)
 
 	f.SharedMeta.mergeMut(gt)
+	f.Fragment.metaTracer().set(f.Fragment, "shared", f.SharedMeta, gt, "setSharedMeta", currentLuaLine(L))
 
 	return 0
 }
@@ -167,6 +171,7 @@ func fragmentMergeSharedMeta(L *lua.LState) int {
 func fragmentGetBothMeta(L *lua.LState) int {
 	f := checkFragment(L)
 	key := L.CheckString(2)
+	f.readSharedMeta(key)
 	value := getNestedValue(f.SharedMeta, key)
 	if _, isNil := value.(*CoreNil); isNil {
 		value = getNestedValue(f.LocalMeta, key)
@@ -178,6 +183,11 @@ func fragmentGetBothMeta(L *lua.LState) int {
 func fragmentParent(L *lua.LState) int {
 	f := checkFragment(L)
 
+	// The parent can be read and changed freely, so the result cannot be memoized
+	if f.Fragment != nil {
+		f.Fragment.Render.MarkUncacheable()
+	}
+
 	if f.Parent != nil {
 		ud := L.NewUserData()
 		ud.Value = f.Parent
@@ -214,6 +224,14 @@ func fragmentBuilders(L *lua.LState) int {
 	}
 	f.Fragment.Builders.mergeMut(gt)
 
+	if f.Fragment.Render != nil {
+		for key, k := range gt.v {
+			if fn, ok := k.(*CoreFunction); ok {
+				f.Fragment.Render.DefineBuilder(key, fn.v)
+			}
+		}
+	}
+
 	return 0
 }
 
@@ -222,7 +240,7 @@ func fragmentGetBuilders(L *lua.LState) int {
 	if f.Fragment.Builders == nil {
 		f.Fragment.Builders = NewEmptyCoreTable()
 	}
-	L.Push(f.Fragment.Builders.luaType(L))
+	L.Push(builderTable(L, f.Fragment.Builders))
 	return 1
 }
 
@@ -237,17 +255,43 @@ func fragmentSetTemplate(L *lua.LState) int {
 	}
 
 	// Set real fragment's template member to a pointer to the template fragment referenced by name
-	t := GetFragmentFromName(L.CheckString(2), TEMPLATE, f.Fragment.FragmentCache)
+	name := L.CheckString(2)
+	f.Fragment.Render.AddDependency(Dependency{DEP_TEMPLATE, name})
+	f.Fragment.FragmentCache.graph.addEdge(f.Fragment, Dependency{DEP_TEMPLATE, name}, "setTemplate")
+	t, err := GetFragmentFromName(name, TEMPLATE, f.Fragment.FragmentCache)
+	if err != nil {
+		L.RaiseError("%s", err.Error())
+		return 0
+	}
 	f.Fragment.Template = t
+	f.Fragment.templateLine = currentLuaLine(L)
 
 	t.FragmentCache = f.Fragment.FragmentCache
+	t.Render = f.Fragment.Render
+
+	return 0
+}
 
+// fragmentSetCacheable lets a fragment opt out of memoization, for example when its output depends
+// on the time or on files it reads itself: this:setCacheable(false)
+func fragmentSetCacheable(L *lua.LState) int {
+	f := checkFragment(L)
+	if !L.CheckBool(2) && f.Fragment != nil {
+		f.Fragment.Render.MarkUncacheable()
+	}
 	return 0
 }
 
-func (f *LFragment) registerThisFragmentAs(L *lua.LState, name string) {
+// readSharedMeta notes a read of the fragment's shared metadata, see RenderContext.ReadSharedMeta.
+func (f *LFragment) readSharedMeta(key string) {
+	if f.Fragment != nil && f.Fragment.Render != nil {
+		f.Fragment.Render.ReadSharedMeta(key)
+	}
+}
+
+func (f *LFragment) registerThisFragmentAs(L *lua.LState, env *lua.LTable, name string) {
 	ud := L.NewUserData()
 	ud.Value = f
 	L.SetMetatable(ud, L.GetTypeMetatable(luaFragmentTypeName))
-	L.SetGlobal(name, ud)
+	env.RawSetString(name, ud)
 }
@@ -11,13 +11,28 @@ type LFragmentsModule struct {
 	FragmentCache *FragmentCache
 	FragPath      string
 	PagePath      string
+	Render        *RenderContext
+	Fragment      *Fragment // The fragment whose Lua section the module was created for
 }
 
-func newFragmentsModule(fragmentCache *FragmentCache, fragPath string, pagePath string) *LFragmentsModule {
+func newFragmentsModule(fragmentCache *FragmentCache, fragPath string, pagePath string, render *RenderContext, fragment *Fragment) *LFragmentsModule {
 	return &LFragmentsModule{
 		FragmentCache: fragmentCache,
 		FragPath:      fragPath,
 		PagePath:      pagePath,
+		Render:        render,
+		Fragment:      fragment,
+	}
+}
+
+// recordDependency notes that the page being rendered read something through the module, using
+// the named module function.
+func (m *LFragmentsModule) recordDependency(dep Dependency, via string) {
+	m.FragmentCache.graph.addEdge(m.Fragment, dep, via)
+	if m.Render != nil {
+		m.Render.AddDependency(dep)
+		// What the module returns can change without the fragment's own inputs changing
+		m.Render.MarkUncacheable()
 	}
 }
 
@@ -56,18 +71,19 @@ func fragmentsModuleGetAllPages(L *lua.LState) int {
 		return 0
 	}
 
+	f.recordDependency(Dependency{Kind: DEP_ALL_PAGES}, "getAllPages")
+
 	fc := f.FragmentCache
-	pages := fc.Cache
+	fc.DiscoverPages("", f.Render)
+	pages := fc.GetAll(PAGE)
 
 	tbl := L.NewTable()
-	for name, frag := range pages {
-		if frag.Type == PAGE {
-			lf := frag.MakeLFragment()
-			ud := L.NewUserData()
-			ud.Value = lf
-			L.SetMetatable(ud, L.GetTypeMetatable(luaFragmentTypeName))
-			tbl.RawSetString(name, ud)
-		}
+	for _, name := range sortedNames(pages) {
+		lf := pages[name].MakeLFragment()
+		ud := L.NewUserData()
+		ud.Value = lf
+		L.SetMetatable(ud, L.GetTypeMetatable(luaFragmentTypeName))
+		tbl.RawSetString(name, ud)
 	}
 
 	L.Push(tbl)
@@ -93,11 +109,13 @@ func fragmentsModuleGetFragment(L *lua.LState) int {
 		return 0
 	}
 
+	f.recordDependency(Dependency{DEP_FRAGMENT, name}, "getFragment")
+
 	fc := f.FragmentCache
-	frag := fc.Get(name, FRAGMENT)
+	frag, err := fc.Get(name, FRAGMENT, f.Render)
 
-	if frag == nil {
-		L.RaiseError("Fragment not found: %s", name)
+	if err != nil {
+		L.RaiseError("%s", err.Error())
 		return 0
 	}
 	lf := frag.MakeLFragment()
@@ -127,11 +145,13 @@ func fragmentsModuleGetPage(L *lua.LState) int {
 		return 0
 	}
 
+	f.recordDependency(Dependency{DEP_PAGE, name}, "getPage")
+
 	fc := f.FragmentCache
-	frag := fc.Get(name, PAGE)
+	frag, err := fc.Get(name, PAGE, f.Render)
 
-	if frag == nil {
-		L.RaiseError("Fragment not found: %s", name)
+	if err != nil {
+		L.RaiseError("%s", err.Error())
 		return 0
 	}
 	lf := frag.MakeLFragment()
@@ -160,24 +180,27 @@ func fragmentsModuleGetBuilders(L *lua.LState) int {
 	var ft FragmentType
 	if kind == "page" {
 		ft = PAGE
+		f.recordDependency(Dependency{DEP_PAGE, name}, "getBuilders")
 	} else if kind == "fragment" {
 		ft = FRAGMENT
+		f.recordDependency(Dependency{DEP_FRAGMENT, name}, "getBuilders")
 	} else if kind == "template" {
 		ft = TEMPLATE
+		f.recordDependency(Dependency{DEP_TEMPLATE, name}, "getBuilders")
 	} else {
 		L.ArgError(2, "kind must be 'fragment', 'page', or 'template'")
 	}
 
-	frag := f.FragmentCache.Get(name, ft)
-	if frag == nil {
-		L.RaiseError("Fragment not found: %s", name)
+	frag, err := f.FragmentCache.Get(name, ft, f.Render)
+	if err != nil {
+		L.RaiseError("%s", err.Error())
 		return 0
 	}
 
 	if frag.Builders == nil {
 		frag.Builders = NewEmptyCoreTable()
 	}
-	L.Push(frag.Builders.luaType(L))
+	L.Push(builderTable(L, frag.Builders))
 	return 1
 }
 
@@ -196,11 +219,15 @@ func fragmentsModuleGetPagesUnder(L *lua.LState) int {
 		return 0
 	}
 
+	f.recordDependency(Dependency{DEP_PAGES_UNDER, prefix}, "getPagesUnder")
+
 	fc := f.FragmentCache
+	fc.DiscoverPages(prefix, f.Render)
+	pages := fc.GetAll(PAGE)
 	tbl := L.NewTable()
-	for name, frag := range fc.Cache {
-		if frag.Type == PAGE && strings.HasPrefix(name, prefix) {
-			lf := frag.MakeLFragment()
+	for _, name := range sortedNames(pages) {
+		if strings.HasPrefix(name, prefix) {
+			lf := pages[name].MakeLFragment()
 			ud := L.NewUserData()
 			ud.Value = lf
 			L.SetMetatable(ud, L.GetTypeMetatable(luaFragmentTypeName))
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Ways a page or template can change a block of its template.
+const (
+	BLOCK_REPLACE = "replace"
+	BLOCK_APPEND  = "append"
+	BLOCK_PREPEND = "prepend"
+)
+
+// BlockNode is a %{block name}...%{end} region. In the outermost template of a page it defines the
+// region and its default content. In a page or template that sets a template of its own, it
+// replaces, appends to or prepends to the region of the same name instead, and renders nothing
+// where it is written.
+type BlockNode struct {
+	Name   string
+	Mode   string
+	Nodes  []Node
+	line   int
+	column int
+}
+
+// blockOverride is the content a page or template gives a block of its template.
+type blockOverride struct {
+	Mode     string
+	Content  string
+	Fragment *Fragment
+	Line     int
+	Column   int
+	used     bool
+}
+
+func parseBlock(lexer *Lexer, f *Fragment, d *directive) (*BlockNode, error) {
+	node := &BlockNode{Mode: BLOCK_REPLACE, line: d.line, column: d.column}
+	if len(d.words) < 2 || len(d.words) > 3 || !slotName.MatchString(d.words[1]) {
+		return nil, &ParseError{
+			Line:     d.line,
+			Column:   d.column,
+			Message:  "A block is written %{block name}, %{block name append} or %{block name prepend}",
+			Fragment: f,
+			Code:     lexer.code(),
+		}
+	}
+	node.Name = d.words[1]
+	if len(d.words) == 3 {
+		switch d.words[2] {
+		case BLOCK_APPEND, BLOCK_PREPEND, BLOCK_REPLACE:
+			node.Mode = d.words[2]
+		default:
+			return nil, &ParseError{
+				Line:     d.line,
+				Column:   d.column,
+				Message:  fmt.Sprintf("Unknown block mode `%s` (expected append, prepend or replace)", d.words[2]),
+				Fragment: f,
+				Code:     lexer.code(),
+			}
+		}
+	}
+
+	nodes, end, err := parseNodes(lexer, f)
+	if err != nil {
+		return nil, err
+	}
+	if end != nil && end.name() != "end" {
+		return nil, end.unexpected(lexer)
+	}
+	if end == nil {
+		return nil, &ParseError{
+			Line:     d.line,
+			Column:   d.column,
+			Message:  fmt.Sprintf("Block `%s` is missing its %%{end}", node.Name),
+			Fragment: f,
+			Code:     lexer.code(),
+		}
+	}
+	node.Nodes = nodes
+	return node, nil
+}
+
+func (n *BlockNode) Evaluate(f *Fragment, L *lua.LState) (string, error) {
+	content, err := evaluateContent(f, L, "", n.Nodes, sourcePos{}, n.line, n.column, "block "+n.Name)
+	if err != nil {
+		return "", err
+	}
+
+	if f.Template != nil {
+		f.Render.overrideBlock(n.Name, &blockOverride{Mode: n.Mode, Content: content, Fragment: f, Line: n.line, Column: n.column})
+		return "", nil
+	}
+	return f.Render.resolveBlock(n.Name, content), nil
+}
+
+func (n *BlockNode) Line() int {
+	return n.line
+}
+
+func (n *BlockNode) Column() int {
+	return n.column
+}
+
+// overrideBlock records the content a page or template gives a block of its template. Pages are
+// evaluated before their templates, so overrides are recorded innermost first.
+func (r *RenderContext) overrideBlock(name string, o *blockOverride) {
+	if r.blocks == nil {
+		r.blocks = make(map[string][]*blockOverride)
+	}
+	r.blocks[name] = append(r.blocks[name], o)
+}
+
+// resolveBlock returns the content of a block defined with the given default content. The overrides
+// of the templates are applied outermost first, so that a page has the last word over the templates
+// it goes through. Overrides from the same file are applied in the order they are written.
+func (r *RenderContext) resolveBlock(name string, content string) string {
+	// The block's content depends on the page it is rendered for, so an included fragment that
+	// defines a block cannot be reused on another page
+	r.MarkUncacheable()
+
+	overrides := r.blocks[name]
+	for end := len(overrides); end > 0; {
+		start := end - 1
+		for start > 0 && overrides[start-1].Fragment == overrides[end-1].Fragment {
+			start--
+		}
+		for _, o := range overrides[start:end] {
+			o.used = true
+			switch o.Mode {
+			case BLOCK_APPEND:
+				content += o.Content
+			case BLOCK_PREPEND:
+				content = o.Content + content
+			default:
+				content = o.Content
+			}
+		}
+		end = start
+	}
+	return content
+}
+
+// reportUnusedBlocks warns about overrides of blocks that no template of the page defines.
+func (r *RenderContext) reportUnusedBlocks() {
+	for name, overrides := range r.blocks {
+		for _, o := range overrides {
+			if o.used {
+				continue
+			}
+			r.ReportWarningOnce(fmt.Sprintf("block:%s:%d:%d", o.Fragment.Path, o.Line, o.Column), &LintWarning{
+				Rule:     RULE_UNKNOWN_BLOCK,
+				Path:     o.Fragment.displayPath(),
+				Line:     o.Line,
+				Column:   o.Column,
+				Message:  fmt.Sprintf("Block `%s` is not defined by any template of this page, so its content is dropped", name),
+				Fragment: o.Fragment,
+				Code:     o.Fragment.Code,
+			})
+		}
+	}
+}
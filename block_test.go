@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func blockFixture(page string) map[string]string {
+	return map[string]string{
+		"fragment/base.frag": "~~~\n<head>%{block head}<title>base</title>%{end}</head><main>${CONTENT}</main>%{block scripts}<script>a</script>%{end}",
+		"fragment/post.frag": "this:setTemplate(\"base\")\n~~~\n%{block scripts append}<script>post</script>%{end}<article>${CONTENT}</article>",
+		"page/index.frag":    page,
+	}
+}
+
+func TestBlockModes(t *testing.T) {
+	tests := []struct {
+		name string
+		page string
+		want string
+	}{
+		{
+			"defaults",
+			"this:setTemplate(\"base\")\n~~~\n<p>x</p>",
+			"<head> <title> base </title> </head> <main> <p> x </p> </main> <script> a </script>",
+		},
+		{
+			"replace",
+			"this:setTemplate(\"base\")\n~~~\n%{block head}<title>page</title>%{end}<p>x</p>",
+			"<head> <title> page </title> </head> <main> <p> x </p> </main> <script> a </script>",
+		},
+		{
+			"prepend and append",
+			"this:setTemplate(\"base\")\n~~~\n%{block scripts prepend}<script>p</script>%{end}%{block head append}<meta>%{end}<p>x</p>",
+			"<head> <title> base </title> <meta> </head> <main> <p> x </p> </main> <script> p </script> <script> a </script>",
+		},
+		{
+			"chained templates apply the page last",
+			"this:setTemplate(\"post\")\n~~~\n%{block scripts append}<script>page</script>%{end}<p>x</p>",
+			"<head> <title> base </title> </head> <main> <article> <p> x </p> </article> </main> <script> a </script> <script> post </script> <script> page </script>",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, d := renderPage(t, blockFixture(tt.page), "index")
+			requireNoErrors(t, d)
+			if out != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnknownBlockIsWarned(t *testing.T) {
+	_, d := renderPage(t, blockFixture("this:setTemplate(\"base\")\n~~~\n%{block footer}<p>gone</p>%{end}<p>x</p>"), "index")
+	requireNoErrors(t, d)
+	warned := 0
+	for _, item := range d.Items() {
+		if strings.Contains(stripANSI(item.Err.Error()), "Block `footer` is not defined by any template") {
+			warned++
+		}
+	}
+	if warned != 1 {
+		t.Errorf("expected the unknown block to be warned about once, got %d warnings", warned)
+	}
+}
+
+func TestBlockParseErrors(t *testing.T) {
+	tests := []struct {
+		content string
+		message string
+	}{
+		{"%{block}x%{end}", "A block is written %{block name}"},
+		{"%{block head sideways}x%{end}", "Unknown block mode `sideways`"},
+		{"%{block head}x", "Block `head` is missing its %{end}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.content, func(t *testing.T) {
+			_, err := ParseCode(tt.content, nil)
+			if err == nil {
+				t.Fatalf("expected an error containing %q", tt.message)
+			}
+			if got := stripANSI(err.Error()); !strings.Contains(got, tt.message) {
+				t.Errorf("got %q, want it to contain %q", got, tt.message)
+			}
+		})
+	}
+}
+
+func TestEscapedDirective(t *testing.T) {
+	out, d := renderPage(t, map[string]string{"page/index.frag": "~~~\n<p>\\%{block head}</p>"}, "index")
+	requireNoErrors(t, d)
+	if want := "<p> %{block head} </p>"; out != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+}
+
+func TestPercentBraceIsTextUnlessDirective(t *testing.T) {
+	css := "<style>@keyframes a{0%{opacity:0}100%{opacity:1}}</style>"
+	out, d := renderPage(t, map[string]string{"page/index.frag": "~~~\n" + css + "<p>50%{x}</p>"}, "index")
+	requireNoErrors(t, d)
+	if !strings.Contains(out, "0%{opacity:0}100%{opacity:1}") || !strings.Contains(out, "50%{x}") {
+		t.Errorf("percentages followed by braces were not kept as text: %s", out)
+	}
+}
+
+func TestPercentEscape(t *testing.T) {
+	out, d := renderPage(t, map[string]string{"page/index.frag": "~~~\n<p>\\%</p><p>\\\\%</p>"}, "index")
+	requireNoErrors(t, d)
+	if want := "<p> % </p> <p> \\% </p>"; out != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+}
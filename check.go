@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	lua "github.com/yuin/gopher-lua"
+)
+
+var (
+	// luaWord matches the identifiers and words of a Lua section. Any of them may name a meta key
+	// or a builder, so a reference to a name that appears in no Lua section can never resolve.
+	luaWord = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_-]*`)
+
+	// luaSetTemplate matches setTemplate calls with a literal template name.
+	luaSetTemplate = regexp.MustCompile(`setTemplate\s*\(?\s*["']([^"']+)["']`)
+)
+
+// sandboxModules are the preloaded modules a sandboxed Lua VM can still require. The others reach
+// the filesystem, the network or other processes.
+var sandboxModules = map[string]bool{
+	"base64": true, "crypto": true, "humanize": true, "inspect": true, "json": true, "regexp": true,
+	"shellescape": true, "stats": true, "strings": true, "template": true, "time": true, "yaml": true,
+}
+
+// sandboxOSFunctions are the functions of the os library a sandboxed Lua VM keeps.
+var sandboxOSFunctions = []string{"clock", "date", "difftime", "time"}
+
+// sandboxLuaState takes away everything in L that could have side effects outside of the VM: the
+// io library, most of os, loading files, and the modules that are not in sandboxModules, which
+// fail with an error saying so when they are required.
+func sandboxLuaState(L *lua.LState) {
+	pkg := L.GetField(L.Get(lua.EnvironIndex), "package")
+	preload := L.GetField(pkg, "preload").(*lua.LTable)
+	loaded := L.GetField(pkg, "loaded").(*lua.LTable)
+	var blocked []string
+	preload.ForEach(func(k, _ lua.LValue) {
+		if !sandboxModules[k.String()] {
+			blocked = append(blocked, k.String())
+		}
+	})
+	for _, name := range blocked {
+		name := name
+		preload.RawSetString(name, L.NewFunction(func(L *lua.LState) int {
+			L.RaiseError("module `%s` is not available to `fragments check`, which runs Lua without filesystem, network or process access", name)
+			return 0
+		}))
+	}
+
+	os := L.NewTable()
+	if lib, ok := L.GetGlobal("os").(*lua.LTable); ok {
+		for _, name := range sandboxOSFunctions {
+			os.RawSetString(name, lib.RawGetString(name))
+		}
+	}
+	L.SetGlobal("os", os)
+	loaded.RawSetString("os", os)
+	loaded.RawSetString("io", lua.LNil)
+	for _, name := range []string{"io", "dofile", "loadfile"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+}
+
+// checkFile is a page or fragment read by Check.
+type checkFile struct {
+	label    string // Path relative to the site root, used to group diagnostics
+	fragment *Fragment
+	nodes    []Node
+}
+
+// Check validates the site without rendering it or touching the build directory. It parses every
+// page and fragment, checks that every fragment and template they refer to exists, runs the Lua
+// section of every page the same way the metadata phase of a build does, but sandboxed, and flags
+// meta and builder references that no fragment or page could ever satisfy. Any word of a Lua
+// section counts as a name that could be set, so references to keys built at run time are trusted.
+func (s *Site) Check() *Diagnostics {
+	s.Diagnostics = NewDiagnostics()
+	s.Cache.Sandbox = true
+
+	var files []*checkFile
+	for _, name := range sortedNames(s.Pages) {
+		files = append(files, s.checkSource(s.Pages[name]))
+	}
+	for _, name := range s.Cache.fragmentNames(FRAGMENT) {
+		f, err := GetFragmentFromName(name, FRAGMENT, s.Cache)
+		if err != nil {
+			s.report(name, err)
+			continue
+		}
+
+		// Fragments only run when they are included, so check their Lua statically
+		file := s.checkSource(f)
+		if _, err := f.sourceOrCode().Proto(); err != nil {
+			s.report(file.label, f.luaError(err))
+		}
+		luaCode := f.sourceOrCode().LuaCode
+		for _, m := range luaSetTemplate.FindAllStringSubmatchIndex(luaCode, -1) {
+			if _, err := GetFragmentFromName(luaCode[m[2]:m[3]], TEMPLATE, s.Cache); err != nil {
+				pos := positionAt(luaCode, m[0])
+				s.report(file.label, &LuaError{Line: pos.Line, Column: pos.Column, Message: err.Error(), Fragment: f, Path: f.Path, Code: f.Code, Cause: err})
+			}
+		}
+		files = append(files, file)
+	}
+
+	// Dry run of the Lua section of every page, which also checks their setTemplate calls
+	s.forEachPage(s.Pages, func(_ string, v *Fragment) {
+		v.EvaluateMeta()
+		s.Diagnostics.ReportPage(v.displayPath(), v.Render)
+	})
+
+	known := s.knownNames(files)
+	for _, file := range files {
+		s.checkReferences(file, file.nodes, known)
+	}
+
+	s.Diagnostics.printSummary("Check", "File")
+	log.Info("Check finished", "pages", len(s.Pages), "fragments", len(files)-len(s.Pages), "errors", s.Diagnostics.Count(SEVERITY_ERROR), "warnings", s.Diagnostics.Count(SEVERITY_WARNING))
+	return s.Diagnostics
+}
+
+// checkSource parses the content of f, reporting a parse error if it does not parse.
+func (s *Site) checkSource(f *Fragment) *checkFile {
+	file := &checkFile{label: f.displayPath(), fragment: f}
+	nodes, err := f.sourceOrCode().Nodes(f)
+	if err != nil {
+		s.report(file.label, err)
+		return file
+	}
+	file.nodes = nodes
+	return file
+}
+
+// knownNames collects every name a meta key or builder could have: the words of every Lua section,
+// the keys of the metadata and builders the pages set during the dry run, and the names of the
+// blocks and props passed to fragments, which they read as ${slot.name} and ${name}, and the
+// variables of %{for} loops.
+func (s *Site) knownNames(files []*checkFile) map[string]bool {
+	known := map[string]bool{"CONTENT": true, "slot": true}
+	for _, file := range files {
+		for _, w := range luaWord.FindAllString(file.fragment.sourceOrCode().LuaCode, -1) {
+			known[w] = true
+		}
+		addPassedNames(file.nodes, known)
+	}
+	for _, f := range s.Cache.GetAll(PAGE) {
+		for _, key := range metaKeys(f.SharedMeta, &f.LocalMeta, f.Builders) {
+			for _, part := range strings.Split(key, ".") {
+				known[part] = true
+			}
+		}
+	}
+	return known
+}
+
+func addPassedNames(nodes []Node, known map[string]bool) {
+	for _, node := range nodes {
+		switch n := node.(type) {
+		case *MetaReferenceNode:
+			addPassedNames(n.Nodes, known)
+		case *BuilderReferenceNode:
+			addPassedNames(n.Nodes, known)
+			for _, prop := range n.Props {
+				addPassedNames(prop.Nodes, known)
+			}
+		case *BlockNode:
+			addPassedNames(n.Nodes, known)
+		case *IfNode:
+			for _, branch := range n.Branches {
+				addPassedNames(branch.Nodes, known)
+			}
+			addPassedNames(n.Else, known)
+		case *ForNode:
+			known[n.Var] = true
+			addPassedNames(n.Nodes, known)
+			addPassedNames(n.Else, known)
+		case *FragmentReferenceNode:
+			addPassedNames(n.Nodes, known)
+			for _, slot := range n.Slots {
+				known[slot.Name] = true
+				addPassedNames(slot.Nodes, known)
+			}
+			for _, prop := range n.Props {
+				known[prop.Name] = true
+				addPassedNames(prop.Nodes, known)
+			}
+		}
+	}
+}
+
+// checkReferences checks the references in nodes, and in the content passed to them.
+func (s *Site) checkReferences(file *checkFile, nodes []Node, known map[string]bool) {
+	f := file.fragment
+	for _, node := range nodes {
+		switch n := node.(type) {
+		case *MetaReferenceNode:
+			if n.hasFallback {
+				// A key that is never set just renders its default
+				s.checkNested(file, n.Fallback, n.Nodes, n.fallbackPos, known)
+				continue
+			}
+			s.checkKey(file, n.Key, n.line, n.column, known)
+		case *BuilderReferenceNode:
+			if !known[n.Name] {
+				s.report(file.label, &EvaluationError{
+					Line:        n.line,
+					Column:      n.column,
+					Message:     fmt.Sprintf("Builder `%s` is never defined by any fragment or page", n.Name),
+					Fragment:    f,
+					Code:        f.Code,
+					Suggestions: suggestNames(n.Name, knownList(known)),
+				})
+			}
+			s.checkNested(file, n.Content, n.Nodes, n.contentPos, known)
+			s.checkProps(file, n.Props, known)
+		case *BlockNode:
+			s.checkReferences(file, n.Nodes, known)
+		case *IfNode:
+			for _, branch := range n.Branches {
+				// A condition on a key that is never set can never hold
+				s.checkKey(file, branch.Condition.Key, n.line, n.column, known)
+				s.checkReferences(file, branch.Nodes, known)
+			}
+			s.checkReferences(file, n.Else, known)
+		case *ForNode:
+			s.checkKey(file, n.List, n.line, n.column, known)
+			s.checkReferences(file, n.Nodes, known)
+			s.checkReferences(file, n.Else, known)
+		case *FragmentReferenceNode:
+			if _, err := GetFragmentFromName(n.Name, FRAGMENT, s.Cache); err != nil {
+				s.report(file.label, n.includeError(f, err))
+			}
+			s.checkNested(file, n.Content, n.Nodes, n.contentPos, known)
+			for _, slot := range n.Slots {
+				s.checkNested(file, slot.Content, slot.Nodes, slot.pos, known)
+			}
+			s.checkProps(file, n.Props, known)
+		}
+	}
+}
+
+// checkNested checks the content passed to a reference. Content that does not parse has no nodes,
+// so it is parsed again to report the error.
+func (s *Site) checkNested(file *checkFile, content string, nodes []Node, pos sourcePos, known map[string]bool) {
+	if content == "" {
+		return
+	}
+	if nodes == nil {
+		var err error
+		if nodes, err = ParseCodeAt(content, file.fragment, pos); err != nil {
+			s.report(file.label, err)
+			return
+		}
+	}
+	s.checkReferences(file, nodes, known)
+}
+
+// checkKey reports a metadata key that is never set, because a part of it is not a known name.
+func (s *Site) checkKey(file *checkFile, key string, line, column int, known map[string]bool) {
+	f := file.fragment
+	for _, part := range strings.Split(key, ".") {
+		if !known[part] {
+			s.report(file.label, &EvaluationError{
+				Line:        line,
+				Column:      column,
+				Message:     fmt.Sprintf("Metadata key `%s` is never set by any fragment or page", key),
+				Fragment:    f,
+				Code:        f.Code,
+				Suggestions: suggestNames(part, knownList(known)),
+			})
+			return
+		}
+	}
+}
+
+func (s *Site) checkProps(file *checkFile, props []*Prop, known map[string]bool) {
+	for _, prop := range props {
+		s.checkNested(file, prop.Value, prop.Nodes, prop.pos, known)
+	}
+}
+
+// report logs an error found by Check and adds it to the diagnostics. Errors of the dry run are
+// logged by the pages themselves.
+func (s *Site) report(label string, err error) {
+	log.Error(err.Error())
+	s.Diagnostics.Report(label, SEVERITY_ERROR, err)
+}
+
+func knownList(known map[string]bool) []string {
+	names := make([]string, 0, len(known))
+	for name := range known {
+		names = append(names, name)
+	}
+	return names
+}
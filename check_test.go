@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// checkSite loads the site at configPath and checks it.
+func checkSite(t *testing.T, configPath string) *Diagnostics {
+	t.Helper()
+	s, err := LoadSite(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.Check()
+}
+
+func TestCheckSandboxesLua(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "written.txt")
+	files := map[string]string{
+		"page/write.frag": fmt.Sprintf("require(\"ioutil\").write_file(%q, \"x\")\n~~~\n<p>write</p>", target),
+		"page/io.frag":    fmt.Sprintf("io.open(%q, \"w\")\n~~~\n<p>io</p>", target),
+		"page/exec.frag":  fmt.Sprintf("os.execute(\"touch \" .. %q)\n~~~\n<p>exec</p>", target),
+		"page/safe.frag": "local json = require(\"json\")\n" +
+			"this:setLocalMeta { year = os.date(\"%Y\"), data = json.encode({ 1 }) }\n~~~\n<p>${year} ${data}</p>",
+	}
+	d := checkSite(t, writeSite(t, files))
+
+	requireError(t, d, "module `ioutil` is not available to `fragments check`")
+	if got := d.Count(SEVERITY_ERROR); got != 3 {
+		for _, item := range d.Items() {
+			t.Log(stripANSI(item.Err.Error()))
+		}
+		t.Errorf("expected an error for write, io and exec only, got %d errors", got)
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Errorf("check had side effects: %v", err)
+	}
+}
+
+func TestCheckReportsUnresolvableReferences(t *testing.T) {
+	files := map[string]string{
+		"fragment/card.frag": "this:setLocalMeta { subtitle = \"card\" }\n~~~\n<h2>${title}</h2><p>${subtitle}</p>",
+		"page/index.frag": "this:setSharedMeta { title = \"Home\" }\n~~~\n" +
+			"@{card}\n<p>${descripton}</p>\n<p>${missing[[fallback]]}</p>\n@{sidebar}",
+	}
+	d := checkSite(t, writeSite(t, files))
+
+	var got []string
+	for _, item := range d.Items() {
+		got = append(got, item.Page+": "+strings.SplitN(stripANSI(item.Err.Error()), "\n", 2)[0])
+	}
+	// title and subtitle are set, and a key with a default does not have to be
+	want := []string{
+		"page/index.frag: Evaluation Error at line 4, column 4:",
+		"page/index.frag: Evaluation Error at line 6, column 1:",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	requireError(t, d, "Metadata key `descripton` is never set by any fragment or page")
+	requireError(t, d, "Fragment not found: `sidebar`")
+}
@@ -13,6 +13,10 @@ type Config struct {
 	PagePath      string `yaml:"pages"`
 	IncludePath   string `yaml:"include"`
 	BuildPath     string `yaml:"build"`
+	CachePath     string `yaml:"cache"`
+
+	// MaxIncludeDepth limits how deeply fragments and templates may be nested. Zero uses the default.
+	MaxIncludeDepth int `yaml:"maxIncludeDepth"`
 }
 
 func GetConfiguration(path string) (*Config, error) {
@@ -29,5 +33,9 @@ func GetConfiguration(path string) (*Config, error) {
 
 	// Get the root of the site, the directory in which the config file (provided path) is located
 	cfg.SiteRoot = filepath.Dir(path)
+
+	if cfg.CachePath == "" {
+		cfg.CachePath = ".fragments-cache"
+	}
 	return cfg, nil
 }
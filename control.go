@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// condition is the test of an %{if key} or %{elseif not key} directive.
+type condition struct {
+	Key    string
+	Negate bool
+}
+
+func (c *condition) String() string {
+	if c.Negate {
+		return "not " + c.Key
+	}
+	return c.Key
+}
+
+// ifBranch is the %{if} or one %{elseif} of an IfNode, with the content rendered when its
+// condition holds.
+type ifBranch struct {
+	Condition *condition
+	Nodes     []Node
+}
+
+// IfNode is an %{if key}...%{elseif key}...%{else}...%{end} conditional. A condition holds when the
+// key is set to something other than false, an empty string or an empty table.
+type IfNode struct {
+	Branches []*ifBranch
+	Else     []Node
+	line     int
+	column   int
+}
+
+// ForNode is a %{for item in list}...%{else}...%{end} loop. The content is rendered once for every
+// item of the list, which it reads as ${item}, or ${item.field} if the items are tables. The
+// %{else} content is rendered when the list is empty.
+type ForNode struct {
+	Var    string
+	List   string
+	Nodes  []Node
+	Else   []Node
+	line   int
+	column int
+}
+
+func parseCondition(lexer *Lexer, f *Fragment, d *directive) (*condition, error) {
+	words := d.words[1:]
+	c := &condition{}
+	if len(words) == 2 && words[0] == "not" {
+		c.Negate, words = true, words[1:]
+	}
+	if len(words) != 1 {
+		return nil, &ParseError{
+			Line:     d.line,
+			Column:   d.column,
+			Message:  fmt.Sprintf("A condition is written %%{%s key} or %%{%s not key}", d.name(), d.name()),
+			Fragment: f,
+			Code:     lexer.code(),
+		}
+	}
+	c.Key = words[0]
+	return c, nil
+}
+
+func parseIf(lexer *Lexer, f *Fragment, d *directive) (*IfNode, error) {
+	node := &IfNode{line: d.line, column: d.column}
+	cond, err := parseCondition(lexer, f, d)
+	if err != nil {
+		return nil, err
+	}
+
+	inElse := false
+	for {
+		nodes, end, err := parseNodes(lexer, f)
+		if err != nil {
+			return nil, err
+		}
+		if end == nil {
+			return nil, &ParseError{
+				Line:     d.line,
+				Column:   d.column,
+				Message:  fmt.Sprintf("`%%{if %s}` is missing its %%{end}", cond),
+				Fragment: f,
+				Code:     lexer.code(),
+			}
+		}
+		if inElse {
+			node.Else = nodes
+		} else {
+			node.Branches = append(node.Branches, &ifBranch{Condition: cond, Nodes: nodes})
+		}
+
+		switch {
+		case end.name() == "end":
+			return node, nil
+		case end.name() == "elseif" && !inElse:
+			if cond, err = parseCondition(lexer, f, end); err != nil {
+				return nil, err
+			}
+		case end.name() == "else" && !inElse:
+			inElse = true
+		default:
+			return nil, end.unexpected(lexer)
+		}
+	}
+}
+
+func parseFor(lexer *Lexer, f *Fragment, d *directive) (*ForNode, error) {
+	if len(d.words) != 4 || d.words[2] != "in" || !slotName.MatchString(d.words[1]) {
+		return nil, &ParseError{
+			Line:     d.line,
+			Column:   d.column,
+			Message:  "A loop is written %{for item in list}",
+			Fragment: f,
+			Code:     lexer.code(),
+		}
+	}
+	node := &ForNode{Var: d.words[1], List: d.words[3], line: d.line, column: d.column}
+
+	inElse := false
+	for {
+		nodes, end, err := parseNodes(lexer, f)
+		if err != nil {
+			return nil, err
+		}
+		if end == nil {
+			return nil, &ParseError{
+				Line:     d.line,
+				Column:   d.column,
+				Message:  fmt.Sprintf("`%%{for %s in %s}` is missing its %%{end}", node.Var, node.List),
+				Fragment: f,
+				Code:     lexer.code(),
+			}
+		}
+		if inElse {
+			node.Else = nodes
+		} else {
+			node.Nodes = nodes
+		}
+
+		switch {
+		case end.name() == "end":
+			return node, nil
+		case end.name() == "else" && !inElse:
+			inElse = true
+		default:
+			return nil, end.unexpected(lexer)
+		}
+	}
+}
+
+func (n *IfNode) Evaluate(f *Fragment, L *lua.LState) (string, error) {
+	for _, branch := range n.Branches {
+		if truthy(f.lookupMeta(branch.Condition.Key)) != branch.Condition.Negate {
+			return evaluateContent(f, L, "", branch.Nodes, sourcePos{}, n.line, n.column, fmt.Sprintf("%%{if %s}", branch.Condition))
+		}
+	}
+	return evaluateContent(f, L, "", n.Else, sourcePos{}, n.line, n.column, "%{else}")
+}
+
+func (n *IfNode) Line() int {
+	return n.line
+}
+
+func (n *IfNode) Column() int {
+	return n.column
+}
+
+func (n *ForNode) Evaluate(f *Fragment, L *lua.LState) (string, error) {
+	value := f.lookupMeta(n.List)
+	items, err := listItems(value)
+	if _, isNil := value.(*CoreNil); isNil {
+		return "", &EvaluationError{
+			Line:        n.line,
+			Column:      n.column,
+			Message:     fmt.Sprintf("Metadata key not found: `%s`", n.List),
+			Fragment:    f,
+			Code:        f.Code,
+			Suggestions: suggestNames(n.List, metaKeys(f.SharedMeta, &f.LocalMeta, f.loopVars)),
+		}
+	}
+	if err != nil {
+		return "", &EvaluationError{
+			Line:     n.line,
+			Column:   n.column,
+			Message:  fmt.Sprintf("Cannot loop over `%s`: %v", n.List, err),
+			Fragment: f,
+			Code:     f.Code,
+		}
+	}
+	if len(items) == 0 {
+		return evaluateContent(f, L, "", n.Else, sourcePos{}, n.line, n.column, "%{else}")
+	}
+
+	// The loop variable hides a variable of the same name of an enclosing loop until the loop ends
+	if f.loopVars == nil {
+		f.loopVars = NewEmptyCoreTable()
+	}
+	outer, hadOuter := f.loopVars.v[n.Var]
+	defer func() {
+		if hadOuter {
+			f.loopVars.v[n.Var] = outer
+		} else {
+			delete(f.loopVars.v, n.Var)
+		}
+	}()
+
+	var sb strings.Builder
+	for _, item := range items {
+		f.loopVars.v[n.Var] = item
+		s, err := evaluateContent(f, L, "", n.Nodes, sourcePos{}, n.line, n.column, fmt.Sprintf("%%{for %s in %s}", n.Var, n.List))
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(s)
+	}
+	return sb.String(), nil
+}
+
+func (n *ForNode) Line() int {
+	return n.line
+}
+
+func (n *ForNode) Column() int {
+	return n.column
+}
+
+// listItems returns the items of a list, a table with the keys 1 to n, in order.
+func listItems(v CoreType) ([]CoreType, error) {
+	t, ok := v.(*CoreTable)
+	if !ok {
+		return nil, fmt.Errorf("it is %s, not a list", describeValue(v))
+	}
+	keys := make([]int, 0, len(t.v))
+	for k := range t.v {
+		i, err := strconv.Atoi(k)
+		if err != nil {
+			return nil, fmt.Errorf("it is a table with the key `%s`, not a list", k)
+		}
+		keys = append(keys, i)
+	}
+	sort.Ints(keys)
+	items := make([]CoreType, len(keys))
+	for i, k := range keys {
+		if k != i+1 {
+			return nil, fmt.Errorf("it is a table with gaps in its keys, not a list")
+		}
+		items[i] = t.v[strconv.Itoa(k)]
+	}
+	return items, nil
+}
+
+// truthy reports whether a value makes a condition hold.
+func truthy(v CoreType) bool {
+	switch v := v.(type) {
+	case nil, *CoreNil:
+		return false
+	case *CoreBool:
+		return v.v
+	case *CoreString:
+		return v.v != ""
+	case *CoreTable:
+		return len(v.v) > 0
+	}
+	return true
+}
+
+// lookupMeta returns the value of a key as a reference to it would see it: the variables of the
+// loops being evaluated first, then shared and then local metadata.
+func (f *Fragment) lookupMeta(key string) CoreType {
+	if v, ok := f.loopValue(key); ok {
+		return v
+	}
+	f.Render.ReadSharedMeta(key)
+	value := getNestedValue(f.SharedMeta, key)
+	if _, isNil := value.(*CoreNil); isNil {
+		value = getNestedValue(&f.LocalMeta, key)
+	}
+	return value
+}
+
+// loopValue returns the value of a key that starts with the variable of a loop being evaluated. It
+// returns false if the key does not start with one.
+func (f *Fragment) loopValue(key string) (CoreType, bool) {
+	if f.loopVars == nil {
+		return nil, false
+	}
+	name, _, _ := strings.Cut(key, ".")
+	if _, ok := f.loopVars.v[name]; !ok {
+		return nil, false
+	}
+	return getNestedValue(f.loopVars, key), true
+}
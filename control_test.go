@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIf(t *testing.T) {
+	meta := "this:setSharedMeta { yes = true, no = false, empty = \"\", none = {}, name = \"x\" }\n~~~\n"
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"%{if yes}a%{else}b%{end}", "a"},
+		{"%{if no}a%{else}b%{end}", "b"},
+		{"%{if empty}a%{elseif none}b%{elseif name}c%{else}d%{end}", "c"},
+		{"%{if unset}a%{end}", ""},
+		{"%{if not unset}a%{end}", "a"},
+		{"%{if not name}a%{elseif not no}b%{end}", "b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.content, func(t *testing.T) {
+			out, d := renderPage(t, map[string]string{"page/index.frag": meta + "<p>" + tt.content + "</p>"}, "index")
+			requireNoErrors(t, d)
+			want := "<p> " + tt.want + " </p>"
+			if tt.want == "" {
+				want = "<p></p>"
+			}
+			if out != want {
+				t.Errorf("got %s, want %s", out, want)
+			}
+		})
+	}
+}
+
+func TestFor(t *testing.T) {
+	files := map[string]string{
+		"page/index.frag": "this:setSharedMeta {\n" +
+			"    item = \"outer\",\n" +
+			"    empty = {},\n" +
+			"    groups = {\n" +
+			"        { name = \"a\", items = { \"1\", \"2\" } },\n" +
+			"        { name = \"b\", items = { \"3\" } },\n" +
+			"    },\n" +
+			"}\n~~~\n" +
+			"<ul>%{for group in groups}<li>${group.name}:%{for item in group.items}${item}%{end}</li>%{end}</ul>" +
+			"<p>${item}</p><p>%{for x in empty}${x}%{else}none%{end}</p>",
+	}
+	out, d := renderPage(t, files, "index")
+	requireNoErrors(t, d)
+	if want := "<ul> <li> a:12 </li> <li> b:3 </li> </ul> <p> outer </p> <p> none </p>"; out != want {
+		t.Errorf("got\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestForErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		meta    string
+		message string
+	}{
+		{"missing list", "", "Metadata key not found: `items`"},
+		{"not a list", "items = \"abc\"", "Cannot loop over `items`: it is \"abc\", not a list"},
+		{"table", "items = { a = 1 }", "it is a table with the key `a`, not a list"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := map[string]string{
+				"page/index.frag": "this:setSharedMeta { " + tt.meta + " }\n~~~\n%{for item in items}${item}%{end}",
+			}
+			_, d := renderPage(t, files, "index")
+			requireError(t, d, tt.message)
+		})
+	}
+}
+
+func TestControlParseErrors(t *testing.T) {
+	tests := []struct {
+		content string
+		message string
+	}{
+		{"%{if}a%{end}", "A condition is written %{if key} or %{if not key}"},
+		{"%{if a}x%{elseif}y%{end}", "A condition is written %{elseif key}"},
+		{"%{if a}x", "`%{if a}` is missing its %{end}"},
+		{"%{for x of list}a%{end}", "A loop is written %{for item in list}"},
+		{"%{for x in list}a", "`%{for x in list}` is missing its %{end}"},
+		{"%{if a}x%{else}y%{else}z%{end}", "`%{else}` without a matching `%{if}` or `%{for}`"},
+		{"%{for x in list}a%{elseif b}c%{end}", "`%{elseif b}` without a matching `%{if}`"},
+		{"a%{end}", "`%{end}` without a matching `%{block}`, `%{if}` or `%{for}`"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.content, func(t *testing.T) {
+			_, err := ParseCode(tt.content, nil)
+			if err == nil {
+				t.Fatalf("expected an error containing %q", tt.message)
+			}
+			if got := stripANSI(err.Error()); !strings.Contains(got, tt.message) {
+				t.Errorf("got %q, want it to contain %q", got, tt.message)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/k0kubun/pp/v3"
@@ -252,6 +253,19 @@ func (c *CoreTable) clone() CoreType {
 	return NewCoreTable(newMap)
 }
 
+// keys returns the table's keys in sorted order.
+func (c *CoreTable) keys() []string {
+	if c == nil {
+		return nil
+	}
+	keys := make([]string, 0, len(c.v))
+	for k := range c.v {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 type CoreFunction struct{ v *lua.LFunction }
 
 func NewCoreFunction(f *lua.LFunction) *CoreFunction { return &CoreFunction{v: f} }
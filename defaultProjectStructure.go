@@ -23,6 +23,13 @@ include: include
 # The final output directory of your site
 # If you don't want this to be committed to git, make sure to add it to your .gitignore file
 build: build
+
+# The directory where fragments keeps the build manifest used to skip unchanged pages
+# Like the build directory, you probably want to add this to your .gitignore file
+cache: .fragments-cache
+
+# How deeply fragments and templates may include each other before the build gives up
+maxIncludeDepth: 64
 `
 
 const defaultIndexPage = `this:setTemplate("page")
@@ -114,11 +121,14 @@ const defaultPageFragment = `<!DOCTYPE html>
 
 const defaultPostFragment = `this:setTemplate("page")
 
--- We have the following meta available to us for a standard post
--- postTitle
--- postDate
--- postDescription
--- author
+-- The shared meta every post sets; a post that leaves out a required key fails with an error
+-- pointing at its setTemplate call
+this:expects {
+    postTitle = "string",
+    postDate = "date",
+    postDescription = "string?",
+    author = "string?"
+}
 
 ~~~
 <article>
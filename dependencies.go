@@ -0,0 +1,132 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+type DependencyKind string
+
+const (
+	DEP_FRAGMENT    DependencyKind = "fragment"
+	DEP_TEMPLATE    DependencyKind = "template"
+	DEP_PAGE        DependencyKind = "page"
+	DEP_PAGES_UNDER DependencyKind = "pagesUnder"
+	DEP_ALL_PAGES   DependencyKind = "allPages"
+)
+
+// Dependency is something a page read while it was being rendered: a fragment or template file,
+// another page, or a listing query made through the fragments module.
+type Dependency struct {
+	Kind DependencyKind `json:"kind"`
+	Name string         `json:"name"`
+}
+
+type DependencySet struct {
+	deps map[Dependency]struct{}
+}
+
+func NewDependencySet() *DependencySet {
+	return &DependencySet{deps: make(map[Dependency]struct{})}
+}
+
+func (d *DependencySet) Add(dep Dependency) {
+	if d == nil {
+		return
+	}
+	d.deps[dep] = struct{}{}
+}
+
+func (d *DependencySet) Has(dep Dependency) bool {
+	if d == nil {
+		return false
+	}
+	_, ok := d.deps[dep]
+	return ok
+}
+
+func (d *DependencySet) clone() *DependencySet {
+	c := NewDependencySet()
+	if d != nil {
+		for dep := range d.deps {
+			c.deps[dep] = struct{}{}
+		}
+	}
+	return c
+}
+
+// List returns the dependencies sorted by kind and name.
+func (d *DependencySet) List() []Dependency {
+	if d == nil {
+		return nil
+	}
+	list := make([]Dependency, 0, len(d.deps))
+	for dep := range d.deps {
+		list = append(list, dep)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Kind != list[j].Kind {
+			return list[i].Kind < list[j].Kind
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// AffectedBy reports whether a change to the given source invalidates anything in the set.
+// Changes are described with DEP_FRAGMENT for files in the fragments directory (which also covers
+// templates) and DEP_PAGE for files in the pages directory.
+func (d *DependencySet) AffectedBy(change Dependency) bool {
+	if d == nil {
+		return false
+	}
+	switch change.Kind {
+	case DEP_FRAGMENT, DEP_TEMPLATE:
+		return d.Has(Dependency{DEP_FRAGMENT, change.Name}) || d.Has(Dependency{DEP_TEMPLATE, change.Name})
+	case DEP_PAGE:
+		if d.Has(change) || d.Has(Dependency{Kind: DEP_ALL_PAGES}) {
+			return true
+		}
+		// Listings match pages the same way fragments:getPagesUnder does
+		for dep := range d.deps {
+			if dep.Kind == DEP_PAGES_UNDER && strings.HasPrefix(change.Name, dep.Name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AffectedPages returns the sorted names of the pages that must be rebuilt after the given changes.
+// A changed page is affected itself, and any page that read an affected page (through getPage or a
+// listing) is affected in turn.
+func AffectedPages(pageDeps map[string]*DependencySet, changes []Dependency) []string {
+	affected := make(map[string]bool)
+	queue := append([]Dependency(nil), changes...)
+
+	for len(queue) > 0 {
+		change := queue[0]
+		queue = queue[1:]
+
+		if change.Kind == DEP_PAGE {
+			if _, ok := pageDeps[change.Name]; ok {
+				affected[change.Name] = true
+			}
+		}
+
+		for name, deps := range pageDeps {
+			if affected[name] || !deps.AffectedBy(change) {
+				continue
+			}
+			affected[name] = true
+			queue = append(queue, Dependency{DEP_PAGE, name})
+		}
+	}
+
+	names := make([]string, 0, len(affected))
+	for name := range affected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
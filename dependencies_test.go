@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestModuleReadsRecordTransitiveDependencies(t *testing.T) {
+	files := map[string]string{
+		"fragment/inner.frag": "~~~\n<b>inner</b>",
+		"fragment/outer.frag": "this:addBuilders { shout = function(content) return content .. \"!\" end }\n~~~\n<i>@{inner}</i>",
+		"fragment/other.frag": "this:setLocalMeta { text = fragments:getFragment(\"outer\"):getLocalMeta(\"CONTENT\") }\n~~~\n<p>other</p>",
+		// Page a includes outer, so the other pages may read the evaluation it publishes
+		"page/a.frag": "~~~\n@{outer}",
+		"page/b.frag": "local outer = fragments:getFragment(\"outer\")\n~~~\n<p>b</p>",
+		"page/c.frag": "local builders = fragments:getBuilders(\"fragment\", \"outer\")\n~~~\n<p>c</p>",
+		"page/d.frag": "~~~\n@{other}",
+	}
+	s, result := buildSite(t, writeSite(t, files), 1)
+	requireNoErrors(t, result.Diagnostics)
+
+	for _, page := range []string{"a", "b", "c", "d"} {
+		deps := s.Pages[page].Render.Dependencies
+		if !deps.Has(Dependency{DEP_FRAGMENT, "inner"}) {
+			t.Errorf("page %s does not depend on inner, got %v", page, deps.List())
+		}
+	}
+	for _, item := range result.Diagnostics.Items() {
+		if w, ok := item.Err.(*LintWarning); ok && w.Rule == RULE_UNUSED_FRAGMENT {
+			t.Errorf("unexpected warning %q", w.Message)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/charmbracelet/log"
+)
+
+type Severity string
+
+const (
+	SEVERITY_ERROR   Severity = "error"
+	SEVERITY_WARNING Severity = "warning"
+)
+
+// Diagnostic is an error or warning raised during a build. Page is empty for problems that do not
+// belong to a single page, like an include file that could not be copied.
+type Diagnostic struct {
+	Severity Severity
+	Page     string
+	Err      error
+}
+
+// Diagnostics collects every error and warning raised during a build. It is safe for concurrent use.
+type Diagnostics struct {
+	mu    sync.Mutex
+	items []Diagnostic
+}
+
+func NewDiagnostics() *Diagnostics {
+	return &Diagnostics{}
+}
+
+func (d *Diagnostics) Report(page string, severity Severity, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.items = append(d.items, Diagnostic{Severity: severity, Page: page, Err: err})
+}
+
+// ReportPage records the errors and warnings raised while rendering a page.
+func (d *Diagnostics) ReportPage(page string, r *RenderContext) {
+	for _, err := range r.Errors {
+		d.Report(page, SEVERITY_ERROR, err)
+	}
+	for _, err := range r.Warnings {
+		d.Report(page, SEVERITY_WARNING, err)
+	}
+}
+
+// Items returns every diagnostic, ordered by page. Diagnostics of the same page keep the order
+// they were reported in.
+func (d *Diagnostics) Items() []Diagnostic {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	items := append([]Diagnostic(nil), d.items...)
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Page < items[j].Page })
+	return items
+}
+
+func (d *Diagnostics) Count(severity Severity) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for _, item := range d.items {
+		if item.Severity == severity {
+			n++
+		}
+	}
+	return n
+}
+
+func (d *Diagnostics) HasErrors() bool {
+	return d.Count(SEVERITY_ERROR) > 0
+}
+
+// PrintSummary logs the number of errors and warnings of every page that had any, followed by
+// the totals for the build.
+func (d *Diagnostics) PrintSummary() {
+	d.printSummary("Build", "Page")
+}
+
+// printSummary is PrintSummary for an operation other than a build, like a check that groups
+// diagnostics by file rather than by page.
+func (d *Diagnostics) printSummary(operation string, unit string) {
+	type counts struct{ errors, warnings int }
+	pages := make(map[string]*counts)
+	var names []string
+	for _, item := range d.Items() {
+		c, ok := pages[item.Page]
+		if !ok {
+			c = &counts{}
+			pages[item.Page] = c
+			names = append(names, item.Page)
+		}
+		if item.Severity == SEVERITY_ERROR {
+			c.errors++
+		} else {
+			c.warnings++
+		}
+	}
+
+	for _, name := range names {
+		c := pages[name]
+		if name == "" {
+			name = "(site)"
+		}
+		if c.errors > 0 {
+			log.Error(unit+" has problems", "name", name, "errors", c.errors, "warnings", c.warnings)
+		} else {
+			log.Warn(unit+" has problems", "name", name, "errors", c.errors, "warnings", c.warnings)
+		}
+	}
+
+	errors, warnings := d.Count(SEVERITY_ERROR), d.Count(SEVERITY_WARNING)
+	switch {
+	case errors > 0:
+		log.Error(operation+" failed", "errors", errors, "warnings", warnings)
+	case warnings > 0:
+		log.Warn(operation+" succeeded with warnings", "warnings", warnings)
+	}
+}
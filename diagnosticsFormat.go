@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// DiagnosticRecord is the plain, unstyled form of a diagnostic written by --diagnostics-format json.
+type DiagnosticRecord struct {
+	Severity      Severity `json:"severity"`
+	Kind          string   `json:"kind"`
+	Page          string   `json:"page,omitempty"`
+	File          string   `json:"file,omitempty"`
+	Line          int      `json:"line,omitempty"`
+	Column        int      `json:"column,omitempty"`
+	Message       string   `json:"message"`
+	FragmentStack []string `json:"fragmentStack,omitempty"`
+	Suggestions   []string `json:"suggestions,omitempty"`
+}
+
+// Record converts a diagnostic to its plain form. Errors that wrap another positioned error, like
+// an error in the content passed to a fragment, are reported at the position of the innermost one.
+func (d Diagnostic) Record() DiagnosticRecord {
+	rec := DiagnosticRecord{
+		Severity: d.Severity,
+		Kind:     "build-error",
+		Page:     d.Page,
+		Message:  stripANSI(d.Err.Error()),
+	}
+
+	var fragment *Fragment
+	var path string
+	err := d.Err
+	for err != nil {
+		switch e := err.(type) {
+		case *ParseError:
+			rec.Kind, rec.Line, rec.Column, rec.Message, fragment = "parse-error", e.Line, e.Column, e.Message, e.Fragment
+			path = e.Fragment.Path
+			rec.Suggestions = nil
+		case *EvaluationError:
+			rec.Kind, rec.Line, rec.Column, rec.Message, fragment = "evaluation-error", e.Line, e.Column, e.Message, e.Fragment
+			path = e.Fragment.Path
+			rec.Suggestions = e.Suggestions
+		case *LuaError:
+			rec.Kind, rec.Line, rec.Column, rec.Message, fragment = "lua-error", e.Line, e.Column, e.Message, e.Fragment
+			path = e.Path
+			rec.Suggestions = nil
+		case *LintWarning:
+			rec.Kind, rec.Line, rec.Column, rec.Message, fragment = e.Rule, e.Line, e.Column, e.Message, e.Fragment
+			rec.File = e.Path
+		default:
+			if d.Severity == SEVERITY_WARNING && fragment == nil {
+				rec.Kind = "warning"
+			}
+		}
+		next := errors.Unwrap(err)
+		if !isPositioned(next) {
+			break
+		}
+		err = next
+	}
+
+	rec.Message = stripANSI(rec.Message)
+	if fragment != nil {
+		if path != "" {
+			rec.File = fragment.relativePath(path)
+		}
+		for _, frag := range getFragmentStack(fragment) {
+			rec.FragmentStack = append(rec.FragmentStack, frag.Name)
+		}
+	}
+	return rec
+}
+
+func isPositioned(err error) bool {
+	switch err.(type) {
+	case *ParseError, *EvaluationError, *LuaError:
+		return true
+	}
+	return false
+}
+
+// WriteDiagnostics writes every diagnostic to w in the given format: "json" or "sarif". The
+// "text" format writes nothing, since diagnostics are already logged as they are raised. File paths
+// are relative to siteRoot.
+func WriteDiagnostics(w io.Writer, format string, d *Diagnostics, siteRoot string) error {
+	var records []DiagnosticRecord
+	for _, item := range d.Items() {
+		records = append(records, item.Record())
+	}
+
+	var doc interface{}
+	switch format {
+	case "text":
+		return nil
+	case "json":
+		if records == nil {
+			records = []DiagnosticRecord{}
+		}
+		doc = struct {
+			Errors      int                `json:"errors"`
+			Warnings    int                `json:"warnings"`
+			Diagnostics []DiagnosticRecord `json:"diagnostics"`
+		}{d.Count(SEVERITY_ERROR), d.Count(SEVERITY_WARNING), records}
+	case "sarif":
+		doc = sarifLog(records, siteRoot)
+	default:
+		return fmt.Errorf("unknown diagnostics format %q (expected text, json or sarif)", format)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+// SARIF 2.1.0, the subset needed to report results with a location. See
+// https://docs.oasis-open.org/sarif/sarif/v2.1.0/sarif-v2.1.0.html
+type sarifDocument struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool               sarifTool                        `json:"tool"`
+	OriginalURIBaseIDs map[string]sarifArtifactLocation `json:"originalUriBaseIds,omitempty"`
+	Results            []sarifResult                    `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifResult struct {
+	RuleID     string                 `json:"ruleId"`
+	Level      string                 `json:"level"`
+	Message    sarifMessage           `json:"message"`
+	Locations  []sarifLocation        `json:"locations,omitempty"`
+	Properties map[string]interface{} `json:"properties,omitempty"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	URI       string `json:"uri"`
+	URIBaseID string `json:"uriBaseId,omitempty"`
+}
+
+// sarifSrcRoot is the base of the relative file URIs of results, which is the site root.
+const sarifSrcRoot = "%SRCROOT%"
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+}
+
+var sarifRules = []sarifRule{
+	{ID: "parse-error", ShortDescription: sarifMessage{Text: "Fragment content could not be parsed"}},
+	{ID: "evaluation-error", ShortDescription: sarifMessage{Text: "Fragment content could not be evaluated"}},
+	{ID: "lua-error", ShortDescription: sarifMessage{Text: "Fragment Lua section failed"}},
+	{ID: "build-error", ShortDescription: sarifMessage{Text: "The build failed"}},
+	{ID: "warning", ShortDescription: sarifMessage{Text: "Possible problem in the site"}},
+	{ID: RULE_UNUSED_FRAGMENT, ShortDescription: sarifMessage{Text: "Fragment is not used by any page"}},
+	{ID: RULE_UNUSED_BUILDER, ShortDescription: sarifMessage{Text: "Builder is never called"}},
+	{ID: RULE_SHADOWED_META, ShortDescription: sarifMessage{Text: "Local metadata is shadowed by shared metadata"}},
+	{ID: RULE_UNKNOWN_BLOCK, ShortDescription: sarifMessage{Text: "Block is not defined by any template of the page"}},
+	{ID: RULE_UNKNOWN_PROP, ShortDescription: sarifMessage{Text: "Prop is not declared by the fragment's this:expects"}},
+}
+
+func sarifLog(records []DiagnosticRecord, siteRoot string) sarifDocument {
+	results := []sarifResult{}
+	for _, rec := range records {
+		res := sarifResult{
+			RuleID:  rec.Kind,
+			Level:   "error",
+			Message: sarifMessage{Text: withSuggestions(rec.Message, rec.Suggestions)},
+		}
+		if rec.Severity == SEVERITY_WARNING {
+			res.Level = "warning"
+		}
+		if rec.File != "" {
+			loc := sarifLocation{PhysicalLocation: sarifPhysicalLocation{ArtifactLocation: sarifArtifactLocation{URI: rec.File, URIBaseID: sarifSrcRoot}}}
+			if rec.Line > 0 {
+				loc.PhysicalLocation.Region = &sarifRegion{StartLine: rec.Line, StartColumn: rec.Column}
+			}
+			res.Locations = append(res.Locations, loc)
+		}
+		if rec.Page != "" || len(rec.FragmentStack) > 0 {
+			res.Properties = map[string]interface{}{}
+			if rec.Page != "" {
+				res.Properties["page"] = rec.Page
+			}
+			if len(rec.FragmentStack) > 0 {
+				res.Properties["fragmentStack"] = rec.FragmentStack
+			}
+		}
+		results = append(results, res)
+	}
+
+	run := sarifRun{
+		Tool: sarifTool{Driver: sarifDriver{
+			Name:           "fragments",
+			InformationURI: "https://github.com/bluefalconhd/fragments",
+			Rules:          sarifRules,
+		}},
+		Results: results,
+	}
+	if uri := directoryURI(siteRoot); uri != "" {
+		run.OriginalURIBaseIDs = map[string]sarifArtifactLocation{sarifSrcRoot: {URI: uri}}
+	}
+
+	return sarifDocument{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	}
+}
+
+// directoryURI returns the file:// URI of a directory, ending in a slash as SARIF requires for
+// base URIs, or "" if dir is not set.
+func directoryURI(dir string) string {
+	if dir == "" {
+		return ""
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	path := filepath.ToSlash(abs)
+	if !strings.HasPrefix(path, "/") {
+		// Windows paths like C:/site
+		path = "/" + path
+	}
+	if !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+	return (&url.URL{Scheme: "file", Path: path}).String()
+}
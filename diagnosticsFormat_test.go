@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSarifLog(t *testing.T) {
+	cfg := writeSite(t, map[string]string{
+		"page/index.frag": "this:setSharedMeta { title = \"Home\" }\n~~~\n<h1>${titel}</h1>",
+	})
+	s, result := buildSite(t, cfg, 1)
+
+	var buf bytes.Buffer
+	if err := WriteDiagnostics(&buf, "sarif", result.Diagnostics, s.Config.SiteRoot); err != nil {
+		t.Fatal(err)
+	}
+	var doc sarifDocument
+	if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	run := doc.Runs[0]
+	root := filepath.ToSlash(filepath.Dir(cfg))
+	if !strings.HasPrefix(root, "/") {
+		root = "/" + root
+	}
+	if got, want := run.OriginalURIBaseIDs[sarifSrcRoot].URI, "file://"+root+"/"; got != want {
+		t.Errorf("got base URI %q, want %q", got, want)
+	}
+
+	if len(run.Results) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(run.Results))
+	}
+	res := run.Results[0]
+	if want := "Did you mean `title`?"; !strings.Contains(res.Message.Text, want) {
+		t.Errorf("message %q does not contain %q", res.Message.Text, want)
+	}
+	loc := res.Locations[0].PhysicalLocation.ArtifactLocation
+	if loc.URI != "page/index.frag" || loc.URIBaseID != sarifSrcRoot {
+		t.Errorf("got location %+v, want page/index.frag relative to %s", loc, sarifSrcRoot)
+	}
+}
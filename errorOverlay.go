@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// ansiPattern matches terminal escape sequences, which show up in messages that wrap another
+// error's lipgloss-formatted output.
+var ansiPattern = regexp.MustCompile("\x1b\\[[0-9;]*[A-Za-z]")
+
+func stripANSI(s string) string {
+	return ansiPattern.ReplaceAllString(s, "")
+}
+
+// formatErrorHTML is the HTML counterpart of formatError, used by the development server's error
+// overlay. It shows the same header, code snippet and fragment stack.
+func formatErrorHTML(errorType string, line, column int, message, code string, fragment *Fragment) string {
+	var sb strings.Builder
+
+	sb.WriteString(`<section class="fragments-error">`)
+	sb.WriteString(fmt.Sprintf(`<h2>%s at %s:</h2>`, html.EscapeString(errorType), formatPosition(line, column)))
+	sb.WriteString(fmt.Sprintf(`<pre class="fragments-error-message">%s</pre>`, html.EscapeString(stripANSI(message))))
+
+	lines := strings.Split(code, "\n")
+	if startLine, endLine, ok := snippetBounds(lines, line); ok {
+		lineNumberWidth := len(fmt.Sprintf("%d", endLine))
+
+		sb.WriteString(`<pre class="fragments-error-snippet">`)
+		for i := startLine; i < endLine; i++ {
+			currentLineNumber := i + 1
+			lineNumber := fmt.Sprintf("%*d | ", lineNumberWidth, currentLineNumber)
+			if currentLineNumber == line {
+				sb.WriteString(fmt.Sprintf(`<mark>%s%s</mark>`+"\n", html.EscapeString(lineNumber), html.EscapeString(lines[i])))
+				if column > 0 {
+					padding := strings.Repeat(" ", len(lineNumber)) + pointerIndent(lines[i], column)
+					sb.WriteString(fmt.Sprintf(`<span class="fragments-error-pointer">%s^</span>`+"\n", padding))
+				}
+			} else {
+				sb.WriteString(html.EscapeString(lineNumber+lines[i]) + "\n")
+			}
+		}
+		sb.WriteString(`</pre>`)
+	}
+
+	sb.WriteString(`<p class="fragments-error-stack-title">Fragment stack:</p><ul class="fragments-error-stack">`)
+	for _, frag := range getFragmentStack(fragment) {
+		sb.WriteString(fmt.Sprintf(`<li>In %s</li>`, html.EscapeString(frag.Name)))
+	}
+	sb.WriteString(`</ul></section>`)
+
+	return sb.String()
+}
+
+// errorHTML renders any error raised while building a page.
+func errorHTML(err error) string {
+	switch e := err.(type) {
+	case *ParseError:
+		return e.HTML()
+	case *EvaluationError:
+		return e.HTML()
+	case *LuaError:
+		return e.HTML()
+	}
+	return formatErrorHTML("Error", 0, 0, err.Error(), "", nil)
+}
+
+const errorOverlayStyle = `<style>
+#fragments-error-overlay { position: fixed; inset: 0; z-index: 2147483647; overflow: auto; padding: 32px; background: rgba(17, 17, 27, 0.92); color: #cdd6f4; font: 14px/1.5 ui-monospace, SFMono-Regular, Menlo, Consolas, monospace; }
+#fragments-error-overlay header { display: flex; justify-content: space-between; align-items: center; margin-bottom: 16px; }
+#fragments-error-overlay header h1 { margin: 0; font-size: 18px; color: #f38ba8; }
+#fragments-error-overlay button { background: none; border: 1px solid #585b70; border-radius: 6px; color: #cdd6f4; padding: 4px 10px; cursor: pointer; font: inherit; }
+#fragments-error-overlay .fragments-error { margin-bottom: 24px; padding: 16px; border-left: 4px solid #f38ba8; background: #1e1e2e; border-radius: 6px; }
+#fragments-error-overlay .fragments-error h2 { margin: 0 0 8px; font-size: 15px; color: #f38ba8; }
+#fragments-error-overlay pre { margin: 0 0 12px; white-space: pre-wrap; font: inherit; }
+#fragments-error-overlay .fragments-error-message { color: #f9e2af; }
+#fragments-error-overlay .fragments-error-snippet { color: #bac2de; }
+#fragments-error-overlay mark { background: none; color: #cba6f7; font-weight: bold; }
+#fragments-error-overlay .fragments-error-pointer { color: #f38ba8; font-weight: bold; }
+#fragments-error-overlay .fragments-error-stack-title { margin: 0; color: #89dceb; }
+#fragments-error-overlay .fragments-error-stack { margin: 0; padding-left: 16px; list-style: none; color: #89dceb; }
+</style>
+`
+
+// renderErrorOverlay builds the overlay shown on top of a page that failed to build.
+func renderErrorOverlay(page string, errs []error) string {
+	var sb strings.Builder
+	sb.WriteString(errorOverlayStyle)
+	sb.WriteString(`<div id="fragments-error-overlay"><header>`)
+	sb.WriteString(fmt.Sprintf(`<h1>%d error%s while building %s</h1>`, len(errs), plural(len(errs)), html.EscapeString(page)))
+	sb.WriteString(`<button type="button" onclick="this.closest('#fragments-error-overlay').remove()">Close</button></header>`)
+	for _, err := range errs {
+		sb.WriteString(errorHTML(err))
+	}
+	sb.WriteString("</div>\n")
+	return sb.String()
+}
+
+func plural(n int) string {
+	if n == 1 {
+		return ""
+	}
+	return "s"
+}
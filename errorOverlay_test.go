@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestErrorOverlayEscapesErrors(t *testing.T) {
+	files := map[string]string{
+		"page/index.frag": "error(\"<script>alert(1)</script>\")\n~~~\n<p>index</p>",
+	}
+	_, result := buildSite(t, writeSite(t, files), 1)
+	errs := result.Errors["index"]
+	if len(errs) == 0 {
+		t.Fatal("expected index to fail")
+	}
+
+	overlay := renderErrorOverlay("index", errs)
+	if strings.Contains(overlay, "<script>alert") {
+		t.Errorf("the overlay contains the unescaped error:\n%s", overlay)
+	}
+	// The message and the line of the snippet it was raised on
+	if n := strings.Count(overlay, "&lt;script&gt;alert(1)&lt;/script&gt;"); n != 2 {
+		t.Errorf("expected the escaped error in the message and the snippet, got it %d times:\n%s", n, overlay)
+	}
+}
@@ -8,18 +8,6 @@ function formatDate(d)
     return mname .. " " .. tostring(dayNum) .. ", " .. y
 end
 
-function blogpost(id, title, date, author, description)
-    local displayDate = formatDate(date)
-    local dateHtml = ""
-    if displayDate ~= "" then
-        dateHtml = " <i class='secondary'>(" .. displayDate .. ")</i>"
-    end
-    return  "<a class='unstyled-link' href='posts/" .. id .. ".html'><div class='blogpost'>\n" ..
-            "   <h3>" .. title .. dateHtml .. "</h3>\n" ..
-            "   <p>" .. description .. "</p>\n" ..
-            "</div></a>\n"
-end
-
 function sortStringDate(a, b)
     -- Expect YYYY-MM-DD; return true if a is more recent than b (newest-first)
     if a == nil and b == nil then return false end
@@ -30,45 +18,33 @@ function sortStringDate(a, b)
     return a > b
 end
 
+-- Collect the posts into a list, newest first, for the %{for} loop below
+local posts = {}
+for id, f in pairs(fragments:getPagesUnder("posts")) do
+    local date = f:getSharedMeta("postDate") or f:getLocalMeta("postDate") or ""
+    table.insert(posts, {
+        id = id,
+        title = f:getSharedMeta("postTitle") or f:getLocalMeta("postTitle") or id,
+        date = date,
+        displayDate = formatDate(date),
+        author = f:getSharedMeta("author") or f:getLocalMeta("author") or "",
+        description = f:getSharedMeta("postDescription") or f:getLocalMeta("postDescription") or ""
+    })
+end
 
+table.sort(posts, function(a, b)
+    return sortStringDate(a.date, b.date)
+end)
 
-
-this:addBuilders {
-    blogpostList = function()
-        p = {}
-
-        for id, f in pairs(fragments:getPagesUnder("posts")) do
-            local title = f:getSharedMeta("postTitle") or f:getLocalMeta("postTitle") or id
-            local date = f:getSharedMeta("postDate") or f:getLocalMeta("postDate") or ""
-            local author = f:getSharedMeta("author") or f:getLocalMeta("author") or ""
-            local description = f:getSharedMeta("postDescription") or f:getLocalMeta("postDescription") or ""
-            table.insert(p, {
-                id = id,
-                title = title,
-                date = date,
-                author = author,
-                description = description
-            })
-        end
-
-        -- Sort the posts by date
-        table.sort(p, function(a, b)
-            return sortStringDate(a.date, b.date)
-        end)
-
-        if #p == 0 then
-            return "<p class='description'>No posts yet.</p>"
-        end
-
-        local result = ""
-        for i, v in ipairs(p) do
-            result = result .. blogpost(v.id, v.title, v.date, v.author, v.description)
-        end
-
-        return result
-    end
-}
+this:setLocalMeta { posts = posts }
 
 ~~~
 
-*{blogpostList}
+%{for post in posts}
+<a class='unstyled-link' href='posts/${post.id}.html'><div class='blogpost'>
+   <h3>${post.title}%{if post.displayDate} <i class='secondary'>(${post.displayDate})</i>%{end}</h3>
+   <p>${post.description}</p>
+</div></a>
+%{else}
+<p class='description'>No posts yet.</p>
+%{end}
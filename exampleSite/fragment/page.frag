@@ -22,6 +22,7 @@ this:addBuilders {
   @{sitemeta}
   <link rel="stylesheet" href="/style.css">
   @{styles}
+  %{block head}%{end}
 </head>
 <body>
   @{nav}
@@ -31,5 +32,6 @@ this:addBuilders {
   </main>
 
   @{footer}
+  %{block scripts}%{end}
 </body>
 </html>
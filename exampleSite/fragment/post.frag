@@ -1,12 +1,18 @@
 this:setTemplate("page")
 
--- We have the following meta available to us for a standard post
--- postTitle
--- postDate
--- postDescription
--- author
+-- The shared meta every post sets; a post that leaves out a required key fails with an error
+-- pointing at its setTemplate call
+this:expects {
+    postTitle = "string",
+    postDate = "date",
+    postDescription = "string?",
+    author = "string?"
+}
 
 ~~~
+%{block head append}
+  <meta property="article:published_time" content="${postDate}">
+%{end}
 <article>
     <h1>${postTitle}</h1>
     @{markdown[[${CONTENT}]]}
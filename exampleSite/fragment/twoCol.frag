@@ -0,0 +1,2 @@
+~~~
+<div style='display:grid;gap:16px;grid-template-columns:repeat(auto-fit,minmax(260px,1fr));margin:16px 0'><div style='padding:12px;border:1px solid #313244;border-radius:8px;background:#1e1e2e'>@{markdown[[${slot.left[[]]}]]}</div><div style='padding:12px;border:1px solid #313244;border-radius:8px;background:#1e1e2e'>@{markdown[[${slot.right[[*Nothing here yet.*]]}]]}</div></div>
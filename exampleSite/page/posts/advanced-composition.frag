@@ -15,34 +15,9 @@ this:addBuilders {
         end
         return "<div style='margin:16px 0;padding:14px 16px;border-left:4px solid #89b4fa;background:#181825;border-radius:6px;color:#cdd6f4'>" .. html .. "</div>"
     end,
-    twoCol = function(content)
-        local sepStart, sepEnd = string.find(content, "\n---\n", 1, true)
-        local left = content
-        local right = ""
-        if sepStart then
-            left = string.sub(content, 1, sepStart - 1)
-            right = string.sub(content, sepEnd + 1)
-        end
-
-        local leftHTML = renderMarkdown(left)
-        if leftHTML == nil then leftHTML = left end
-        local rightHTML = renderMarkdown(right)
-        if rightHTML == nil then rightHTML = right end
-
-        local wrapOpen = "<div style='display:grid;gap:16px;grid-template-columns:repeat(auto-fit,minmax(260px,1fr));margin:16px 0'>"
-        local colStyle = "padding:12px;border:1px solid #313244;border-radius:8px;background:#1e1e2e"
-        local leftCol = "<div style='" .. colStyle .. "'>" .. leftHTML .. "</div>"
-        local rightCol = "<div style='" .. colStyle .. "'>" .. rightHTML .. "</div>"
-        local wrapClose = "</div>"
-        return wrapOpen .. leftCol .. rightCol .. wrapClose
-    end,
-    linkButton = function(content)
-        local bar = string.find(content, "|", 1, true)
-        if not bar then
-            return content
-        end
-        local href = string.sub(content, 1, bar - 1)
-        local label = string.sub(content, bar + 1)
+    linkButton = function(content, props)
+        local href = props.href
+        local label = props.label or content
         local style = "display:inline-block;background:#89b4fa;color:#11111b;padding:8px 14px;border-radius:8px;text-decoration:none;font-weight:600"
         return "<a href='" .. href .. "' style='" .. style .. "'>" .. label .. "</a>"
     end
@@ -71,16 +46,19 @@ is injected before Markdown is rendered by the post template.
 *{callout[[Pro tip: Builders are just Lua functions that return strings.
 They’re perfect for small, reusable UI patterns.]]}
 
-Here’s another example that renders two columns from a single content block:
+## Named slots
 
-*{twoCol[[
+A fragment can take several blocks of content at once. The `twoCol` fragment
+reads a `left` and a `right` slot as `\${slot.left}` and `\${slot.right}`:
+
+@{twoCol
+left[[
 ### Left column
 - Write Markdown
 - Add lists and links
 - Keep content focused
-
----
-
+]]
+right[[
 ### Right column
 - Use grids with inline styles
 - Compose small, reusable units
@@ -88,14 +66,16 @@ Here’s another example that renders two columns from a single content block:
 ]]}
 
 ### Notes
-This separator (`---`) splits the content into two columns. Everything above it
-is the left column; everything below it becomes the right column.
+Each slot is its own block, so there is no separator to get wrong. A slot the
+caller leaves out renders the default content the fragment gives for it; leave
+out `right` and the second column reads “Nothing here yet.”
 
 ## Cross-linking with styled buttons
 
-Use a tiny builder to create styled links:
+Use a tiny builder to create styled links. Props like `href` and `label` reach
+the builder as a table, next to its content:
 
-*{linkButton[[/about.html|Learn more about this site]]}
+*{linkButton href="/about.html" label="Learn more about this site"}
 
 ## Wrap-up
 
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Types a fragment can expect a prop or metadata key to have. A type followed by ? is optional.
+const (
+	EXPECT_STRING  = "string"
+	EXPECT_NUMBER  = "number"
+	EXPECT_BOOLEAN = "boolean"
+	EXPECT_DATE    = "date" // A string in the form YYYY-MM-DD
+	EXPECT_LIST    = "list" // A table with the keys 1 to n
+	EXPECT_TABLE   = "table"
+	EXPECT_ANY     = "any"
+)
+
+var expectTypes = []string{EXPECT_STRING, EXPECT_NUMBER, EXPECT_BOOLEAN, EXPECT_DATE, EXPECT_LIST, EXPECT_TABLE, EXPECT_ANY}
+
+// expectation is one entry of this:expects, like date = "date?".
+type expectation struct {
+	Name     string
+	Type     string
+	Optional bool
+}
+
+func (e *expectation) String() string {
+	if e.Optional {
+		return e.Type + "?"
+	}
+	return e.Type
+}
+
+func parseExpectation(name, spec string) (*expectation, error) {
+	e := &expectation{Name: name, Type: strings.TrimSpace(spec)}
+	if strings.HasSuffix(e.Type, "?") {
+		e.Type, e.Optional = strings.TrimSpace(strings.TrimSuffix(e.Type, "?")), true
+	}
+	for _, t := range expectTypes {
+		if e.Type == t {
+			return e, nil
+		}
+	}
+	msg := fmt.Sprintf("unknown type %q for `%s` (expected %s, optionally followed by ?)", spec, name, strings.Join(expectTypes, ", "))
+	if s := suggestNames(e.Type, expectTypes); len(s) > 0 {
+		msg += fmt.Sprintf("; did you mean %q?", s[0])
+	}
+	return nil, fmt.Errorf("%s", msg)
+}
+
+// fragmentExpects declares the props and metadata the fragment needs, and their types:
+// this:expects { title = "string", date = "date?", tags = "list" }
+// They are checked every time the fragment is included or used as a template, once its Lua
+// section has run, so that defaults it sets itself count.
+func fragmentExpects(L *lua.LState) int {
+	f := checkFragment(L)
+	table := L.CheckTable(2)
+
+	if f.Fragment.expects == nil {
+		f.Fragment.expects = make(map[string]*expectation)
+	}
+	table.ForEach(func(k, v lua.LValue) {
+		name, ok := k.(lua.LString)
+		if !ok {
+			L.ArgError(2, fmt.Sprintf("expected names as keys, got %s", k.Type().String()))
+		}
+		spec, ok := v.(lua.LString)
+		if !ok {
+			L.ArgError(2, fmt.Sprintf("expected a type name for `%s`, got %s", name, v.Type().String()))
+		}
+		e, err := parseExpectation(string(name), string(spec))
+		if err != nil {
+			L.ArgError(2, err.Error())
+		}
+		f.Fragment.expects[e.Name] = e
+	})
+	f.Fragment.expectsLine = currentLuaLine(L)
+	return 0
+}
+
+// checkExpects checks the metadata of the fragment against what it declared with this:expects. Every
+// mismatch is reported at the reference or setTemplate call the fragment was included from, and
+// props it does not declare are warned about. It returns false if there was a mismatch, in which
+// case the fragment is not rendered.
+func (f *Fragment) checkExpects() bool {
+	if len(f.expects) == 0 {
+		return true
+	}
+
+	names := make([]string, 0, len(f.expects))
+	for name := range f.expects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range f.props {
+		if _, ok := f.expects[name]; ok {
+			continue
+		}
+		message := fmt.Sprintf("Fragment `%s` does not expect the prop `%s`", f.Name, name)
+		if s := suggestNames(name, names); len(s) > 0 {
+			message += fmt.Sprintf("; did you mean `%s`?", s[0])
+		}
+		if frame := f.includeFrame(); frame != nil && frame.From != nil {
+			f.Render.ReportWarningOnce(fmt.Sprintf("prop:%s:%d:%d:%s", frame.From.Path, frame.Line, frame.Column, name), &LintWarning{
+				Rule:     RULE_UNKNOWN_PROP,
+				Path:     frame.From.displayPath(),
+				Line:     frame.Line,
+				Column:   frame.Column,
+				Message:  message,
+				Fragment: frame.From,
+				Code:     frame.From.Code,
+			})
+		}
+	}
+
+	ok := true
+	for _, name := range names {
+		e := f.expects[name]
+		f.Render.ReadSharedMeta(name)
+		value := getNestedValue(f.SharedMeta, name)
+		if _, isNil := value.(*CoreNil); isNil {
+			value = getNestedValue(&f.LocalMeta, name)
+		}
+
+		var problem string
+		if _, isNil := value.(*CoreNil); isNil {
+			if e.Optional {
+				continue
+			}
+			problem = fmt.Sprintf("expects `%s` (%s), but %s", name, e, f.notPassed())
+		} else if !e.matches(value) {
+			problem = fmt.Sprintf("expects `%s` to be %s, but it is %s", name, e.describe(), describeValue(value))
+		} else {
+			continue
+		}
+		ok = false
+		f.Render.ReportError(f.expectsError(problem))
+	}
+	return ok
+}
+
+// notPassed explains where a missing key should have come from.
+func (f *Fragment) notPassed() string {
+	frame := f.includeFrame()
+	switch {
+	case frame == nil || frame.From == nil:
+		return "it is not set"
+	case frame.From.Template == f:
+		return fmt.Sprintf("`%s` does not set it in its shared metadata", frame.From.Name)
+	default:
+		return "no prop or shared metadata sets it"
+	}
+}
+
+// expectsError returns the error for a mismatch, positioned at the include of the fragment, or at
+// its this:expects call if it was not included.
+func (f *Fragment) expectsError(problem string) error {
+	kind := "Fragment"
+	frame := f.includeFrame()
+	if frame == nil || frame.From == nil {
+		if f.Type == PAGE {
+			kind = "Page"
+		}
+		return &LuaError{
+			Line:     f.expectsLine,
+			Message:  fmt.Sprintf("%s `%s` %s", kind, f.Name, problem),
+			Fragment: f,
+			Path:     f.Path,
+			Code:     f.Code,
+		}
+	}
+	if frame.From.Template == f {
+		kind = "Template"
+	}
+	return &EvaluationError{
+		Line:     frame.Line,
+		Column:   frame.Column,
+		Message:  fmt.Sprintf("%s `%s` %s (declared with this:expects at %s:%d)", kind, f.Name, problem, f.displayPath(), f.expectsLine),
+		Fragment: frame.From,
+		Code:     frame.From.Code,
+	}
+}
+
+// includeFrame returns the frame of the include chain that included f, or nil if f is not being
+// included.
+func (f *Fragment) includeFrame() *includeFrame {
+	includes := f.Render.includes
+	if len(includes) == 0 || includes[len(includes)-1].Fragment != f {
+		return nil
+	}
+	return &includes[len(includes)-1]
+}
+
+func (e *expectation) matches(v CoreType) bool {
+	switch e.Type {
+	case EXPECT_STRING:
+		_, ok := v.(*CoreString)
+		return ok
+	case EXPECT_NUMBER:
+		switch v := v.(type) {
+		case *CoreNumber:
+			return true
+		case *CoreString:
+			// Props are always strings
+			_, err := strconv.ParseFloat(strings.TrimSpace(v.v), 64)
+			return err == nil
+		}
+		return false
+	case EXPECT_BOOLEAN:
+		switch v := v.(type) {
+		case *CoreBool:
+			return true
+		case *CoreString:
+			return v.v == "true" || v.v == "false"
+		}
+		return false
+	case EXPECT_DATE:
+		s, ok := v.(*CoreString)
+		if !ok {
+			return false
+		}
+		_, err := time.Parse("2006-01-02", s.v)
+		return err == nil
+	case EXPECT_LIST:
+		t, ok := v.(*CoreTable)
+		if !ok {
+			return false
+		}
+		for i := 1; i <= len(t.v); i++ {
+			if _, ok := t.v[strconv.Itoa(i)]; !ok {
+				return false
+			}
+		}
+		return true
+	case EXPECT_TABLE:
+		_, ok := v.(*CoreTable)
+		return ok
+	}
+	return true
+}
+
+func (e *expectation) describe() string {
+	switch e.Type {
+	case EXPECT_DATE:
+		return "a date (YYYY-MM-DD)"
+	case EXPECT_LIST:
+		return "a list"
+	case EXPECT_ANY:
+		return "set"
+	}
+	return "a " + e.Type
+}
+
+// describeValue describes a value in a type mismatch.
+func describeValue(v CoreType) string {
+	switch v := v.(type) {
+	case *CoreString:
+		return fmt.Sprintf("%q", v.v)
+	case *CoreNumber:
+		return "the number " + strconv.FormatFloat(v.v, 'f', -1, 64)
+	case *CoreBool:
+		return fmt.Sprintf("the boolean %t", v.v)
+	case *CoreTable:
+		return "a table"
+	case *CoreFunction:
+		return "a function"
+	}
+	return v.stringRepresentation()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func expectsFixture(page string) map[string]string {
+	return map[string]string{
+		"fragment/card.frag": "this:expects { title = \"string\", count = \"number?\", date = \"date?\" }\n~~~\n<h2>${title}</h2>",
+		"page/index.frag":    "~~~\n" + page,
+	}
+}
+
+func TestExpectsAccepted(t *testing.T) {
+	out, d := renderPage(t, expectsFixture("@{card title=\"A\" count=\"3\" date=\"2024-01-31\"}@{card title=\"B\"}"), "index")
+	requireNoErrors(t, d)
+	if want := "<h2> A </h2> <h2> B </h2>"; out != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+}
+
+func TestExpectsMismatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		page    string
+		message string
+	}{
+		{"missing", "@{card}", "Fragment `card` expects `title` (string), but no prop or shared metadata sets it"},
+		{"wrong type", "@{card title=\"A\" count=\"many\"}", "expects `count` to be a number, but it is \"many\""},
+		{"bad date", "@{card title=\"A\" date=\"31/01/2024\"}", "expects `date` to be a date (YYYY-MM-DD)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, d := renderPage(t, expectsFixture(tt.page), "index")
+			requireError(t, d, tt.message)
+		})
+	}
+}
+
+func TestExpectsWarnsAboutUnknownProps(t *testing.T) {
+	_, d := renderPage(t, expectsFixture("@{card title=\"A\" titel=\"B\"}"), "index")
+	requireNoErrors(t, d)
+	for _, item := range d.Items() {
+		if w, ok := item.Err.(*LintWarning); ok && w.Rule == RULE_UNKNOWN_PROP {
+			if msg := stripANSI(w.Message); !strings.Contains(msg, "does not expect the prop `titel`; did you mean `title`?") {
+				t.Errorf("unexpected message %q", msg)
+			}
+			return
+		}
+	}
+	t.Error("expected a warning about the unknown prop")
+}
+
+func TestParseExpectation(t *testing.T) {
+	e, err := parseExpectation("tags", " list ? ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != EXPECT_LIST || !e.Optional {
+		t.Errorf("got %s, want list?", e)
+	}
+	if _, err := parseExpectation("tags", "lsit"); err == nil || !strings.Contains(err.Error(), `did you mean "list"?`) {
+		t.Errorf("got %v, want a suggestion of list", err)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Actions of a MetaEvent.
+const (
+	META_SET     = "set"     // A setLocalMeta or setSharedMeta call wrote the key
+	META_MERGE   = "merge"   // Shared metadata passed along with content was merged into a fragment
+	META_INHERIT = "inherit" // A template took over the shared metadata of its page
+	META_PROP    = "prop"    // An include passed the key as a prop
+	META_READ    = "read"    // A ${key} reference was evaluated
+)
+
+// MetaEvent is one step in the life of a metadata key while a page is evaluated.
+type MetaEvent struct {
+	Action   string
+	Scope    string // "shared" or "local"
+	Fragment string // The fragment that was written to or read from
+	From     string // For merges and inherits, the fragment the metadata came from
+	Via      string // The Lua function or mechanism that wrote the key
+	File     string
+	Line     int
+	Column   int
+	Value    string
+	Ignored  string // For reads of shared metadata, the local value that was shadowed
+	Origin   int    // For reads, the number of the event that set the value read, or 0 if unknown
+}
+
+// MetaTrace is the result of `fragments explain`: every write, merge and read of a key on one page,
+// in the order they happened.
+type MetaTrace struct {
+	Page   string
+	Key    string
+	Events []MetaEvent
+}
+
+// metaTracer records the events of a single metadata key for `fragments explain`. A nil tracer
+// records nothing, which is the case outside of `fragments explain`. The traced page is evaluated
+// on a single goroutine, so the tracer needs no locking.
+type metaTracer struct {
+	key    string
+	events []MetaEvent
+
+	// origin holds, for every metadata table that holds the key, the number of the event that put it there
+	origin map[*CoreTable]int
+}
+
+func newMetaTracer(key string) *metaTracer {
+	return &metaTracer{key: key, origin: make(map[*CoreTable]int)}
+}
+
+func (t *metaTracer) add(e MetaEvent) int {
+	t.events = append(t.events, e)
+	return len(t.events)
+}
+
+// set records a write of written into table by f, if written holds the key.
+func (t *metaTracer) set(f *Fragment, scope string, table *CoreTable, written *CoreTable, via string, line int) {
+	if t == nil || f == nil {
+		return
+	}
+	value := getNestedValue(written, t.key)
+	if _, isNil := value.(*CoreNil); isNil {
+		return
+	}
+	t.origin[table] = t.add(MetaEvent{
+		Action:   META_SET,
+		Scope:    scope,
+		Fragment: f.Name,
+		Via:      via,
+		File:     f.displayPath(),
+		Line:     line,
+		Value:    value.stringRepresentation(),
+	})
+}
+
+// merge records shared metadata of from being merged into the shared metadata of f.
+func (t *metaTracer) merge(f *Fragment, from *Fragment, action string, via string) {
+	if t == nil {
+		return
+	}
+	value := getNestedValue(from.SharedMeta, t.key)
+	if _, isNil := value.(*CoreNil); isNil {
+		return
+	}
+	// A prop of the same name keeps the key from being merged
+	if _, isNil := getNestedValue(f.SharedMeta, t.key).(*CoreNil); isNil {
+		return
+	}
+	e := t.add(MetaEvent{
+		Action:   action,
+		Scope:    "shared",
+		Fragment: f.Name,
+		From:     from.Name,
+		Via:      via,
+		File:     from.displayPath(),
+		Value:    value.stringRepresentation(),
+	})
+	// Reads trace the value back to the call that set it, rather than to how it was passed on
+	if origin, ok := t.origin[from.SharedMeta]; ok {
+		t.origin[f.SharedMeta] = origin
+	} else {
+		t.origin[f.SharedMeta] = e
+	}
+}
+
+// prop records the key being passed as a prop to f by the reference at line and column of from.
+func (t *metaTracer) prop(f *Fragment, from *Fragment, props map[string]string, line, column int) {
+	if t == nil {
+		return
+	}
+	value, ok := props[t.key]
+	if !ok {
+		return
+	}
+	t.origin[&f.LocalMeta] = t.add(MetaEvent{
+		Action:   META_PROP,
+		Scope:    "local",
+		Fragment: f.Name,
+		From:     from.Name,
+		File:     from.displayPath(),
+		Line:     line,
+		Column:   column,
+		Value:    value,
+	})
+}
+
+// read records the evaluation of a ${key} reference in f.
+func (t *metaTracer) read(f *Fragment, n *MetaReferenceNode, shared, local CoreType) {
+	if t == nil || n.Key != t.key {
+		return
+	}
+	e := MetaEvent{
+		Action:   META_READ,
+		Fragment: f.Name,
+		File:     f.displayPath(),
+		Line:     n.line,
+		Column:   n.column,
+	}
+	if _, isNil := shared.(*CoreNil); !isNil {
+		e.Scope, e.Value, e.Origin = "shared", shared.stringRepresentation(), t.origin[f.SharedMeta]
+		if _, isNil := local.(*CoreNil); !isNil && local.stringRepresentation() != e.Value {
+			e.Ignored = local.stringRepresentation()
+		}
+	} else if _, isNil := local.(*CoreNil); !isNil {
+		e.Scope, e.Value, e.Origin = "local", local.stringRepresentation(), t.origin[&f.LocalMeta]
+	}
+	t.add(e)
+}
+
+// metaTracer returns the tracer of the current `fragments explain`, if any.
+func (f *Fragment) metaTracer() *metaTracer {
+	if f == nil || f.FragmentCache == nil {
+		return nil
+	}
+	return f.FragmentCache.trace
+}
+
+// Explain evaluates a page, without writing anything, and traces how the metadata key was set,
+// merged and read along the way. Included fragments are not memoized, so that every one of them
+// runs.
+func (s *Site) Explain(page string, key string) (*MetaTrace, error) {
+	f, ok := s.Pages[page]
+	if !ok {
+		_, err := GetFragmentFromName(page, PAGE, s.Cache)
+		if err == nil {
+			err = fmt.Errorf("page not found: `%s`", page)
+		}
+		return nil, err
+	}
+
+	s.Diagnostics = NewDiagnostics()
+	s.Cache.memo = nil
+	// Listings on the page need the metadata of every page
+	s.collectMeta(s.Pages)
+
+	tracer := newMetaTracer(key)
+	s.Cache.trace = tracer
+	defer func() { s.Cache.trace = nil }()
+
+	f.Render.Errors = nil
+	f.Render.Warnings = nil
+	f.Evaluate()
+	s.Diagnostics.ReportPage(page, f.Render)
+
+	return &MetaTrace{Page: page, Key: key, Events: tracer.events}, nil
+}
+
+// WriteText prints the trace as a numbered list of events.
+func (t *MetaTrace) WriteText(w io.Writer) error {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("`%s` on page %s\n\n", t.Key, t.Page))
+	if len(t.Events) == 0 {
+		sb.WriteString("  No fragment set or read this key.\n")
+	}
+
+	reads := 0
+	for i, e := range t.Events {
+		sb.WriteString(fmt.Sprintf("  %2d. ", i+1))
+		switch e.Action {
+		case META_SET:
+			sb.WriteString(fmt.Sprintf("%s sets %s `%s` = %q with %s\n", e.Fragment, e.Scope, t.Key, e.Value, e.Via))
+		case META_MERGE:
+			sb.WriteString(fmt.Sprintf("%s receives shared `%s` = %q from %s (%s)\n", e.Fragment, t.Key, e.Value, e.From, e.Via))
+		case META_INHERIT:
+			sb.WriteString(fmt.Sprintf("%s inherits shared `%s` = %q from %s (%s)\n", e.Fragment, t.Key, e.Value, e.From, e.Via))
+		case META_PROP:
+			sb.WriteString(fmt.Sprintf("%s receives `%s` = %q as a prop from %s\n", e.Fragment, t.Key, e.Value, e.From))
+		case META_READ:
+			reads++
+			if e.Scope == "" {
+				sb.WriteString(fmt.Sprintf("${%s} in %s finds no value\n", t.Key, e.Fragment))
+			} else {
+				sb.WriteString(fmt.Sprintf("${%s} in %s reads %q from %s metadata", t.Key, e.Fragment, e.Value, e.Scope))
+				if e.Origin > 0 {
+					sb.WriteString(fmt.Sprintf(", set in step %d", e.Origin))
+				}
+				sb.WriteString("\n")
+			}
+		}
+		if e.Line > 0 {
+			position := fmt.Sprintf("%s:%d", e.File, e.Line)
+			if e.Column > 0 {
+				position += fmt.Sprintf(":%d", e.Column)
+			}
+			sb.WriteString(fmt.Sprintf("        at %s\n", position))
+		} else if e.File != "" && e.Action == META_SET {
+			sb.WriteString(fmt.Sprintf("        in %s\n", e.File))
+		}
+		if e.Ignored != "" {
+			sb.WriteString(fmt.Sprintf("        the local value %q is ignored, because shared metadata wins\n", e.Ignored))
+		}
+	}
+	if len(t.Events) > 0 && reads == 0 {
+		sb.WriteString(fmt.Sprintf("\n  No ${%s} reference was evaluated on this page.\n", t.Key))
+	}
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExplainEventOrder(t *testing.T) {
+	files := map[string]string{
+		"fragment/page.frag": "~~~\n<title>${title}</title>${CONTENT}",
+		"fragment/card.frag": "this:setLocalMeta { title = \"Card\" }\n~~~\n<h2>${title}</h2>${CONTENT}",
+		"page/index.frag": "this:setTemplate(\"page\")\n" +
+			"this:setSharedMeta { title = \"Home\" }\n~~~\n<h1>${title}</h1>\n@{card [[body]]}",
+	}
+	s, err := LoadSite(writeSite(t, files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Jobs = 1
+	trace, err := s.Explain("index", "title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	requireNoErrors(t, s.Diagnostics)
+
+	type step struct {
+		Action, Fragment, Value, Ignored string
+		Origin                           int
+	}
+	var got []step
+	for _, e := range trace.Events {
+		got = append(got, step{e.Action, e.Fragment, e.Value, e.Ignored, e.Origin})
+	}
+	// The page runs first, then the fragments it includes, and its template last. Every read of
+	// the shared value traces back to the setSharedMeta call of the page.
+	want := []step{
+		{META_SET, "index", "Home", "", 0},
+		{META_READ, "index", "Home", "", 1},
+		{META_MERGE, "card", "Home", "", 0},
+		{META_SET, "card", "Card", "", 0},
+		{META_READ, "card", "Home", "Card", 1},
+		{META_INHERIT, "page", "Home", "", 0},
+		{META_READ, "page", "Home", "", 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
-	"os"
+	"errors"
+	"io/fs"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/charmbracelet/log"
 	libs "github.com/vadv/gopher-lua-libs"
@@ -28,21 +31,119 @@ const (
 
 //type FragmentCache map[string]*Fragment
 
+// FragmentCache holds the latest evaluation of every fragment and page by name. It is shared by
+// all pages of a build and is safe for concurrent use. Fragments are stored as snapshots, so that
+// pages read by listings cannot change while another page is still being evaluated.
 type FragmentCache struct {
+	mu     sync.RWMutex
 	Cache  map[string]*Fragment
 	Config *Config
+
+	// LazyPages makes listings evaluate pages they have not seen yet instead of only returning
+	// the pages already in the cache. It is used when pages are rendered on demand.
+	LazyPages bool
+
+	// Sandbox takes filesystem, network and process access away from the Lua of pages and
+	// fragments. It is used by `fragments check`, which must not have side effects.
+	Sandbox bool
+
+	memo    *memoStore
+	sources *sourceCache
+
+	// graph records which fragment read which while pages are evaluated for `fragments graph`
+	graph *graphRecorder
+
+	// trace records how one metadata key is set and read for `fragments explain`
+	trace *metaTracer
 }
 
 func NewFragmentCache(c *Config) *FragmentCache {
 	return &FragmentCache{
-		Cache:  make(map[string]*Fragment),
-		Config: c,
+		Cache:   make(map[string]*Fragment),
+		Config:  c,
+		memo:    newMemoStore(),
+		sources: newSourceCache(),
 	}
 }
 
+// RenderContext holds the state shared by every fragment evaluated while rendering a single
+// page: the page itself, its template and all of the fragments they include.
+type RenderContext struct {
+	Dependencies *DependencySet
+	Errors       []error
+	Warnings     []error
+
+	// quiet keeps errors from being logged when they are reported, for evaluations whose errors
+	// are reported again by a later evaluation of the same page
+	quiet bool
+
+	// includes is the chain of fragments currently being evaluated, starting with the page
+	includes []includeFrame
+
+	// L is the Lua VM the page is rendered in. It only exists while the page is being evaluated.
+	L *lua.LState
+
+	// memo holds the included fragments currently being evaluated that may be memoized, outermost first
+	memo []*memoRecord
+
+	// warned holds the warnings reported so far, so that a fragment included many times warns once
+	warned map[string]bool
+
+	// blocks holds the content the page and its templates give the blocks of their templates
+	blocks map[string][]*blockOverride
+
+	// usage records the builders registered and called while rendering the page, for lint
+	usage *usageTracker
+
+	// discovering is set for pages evaluated by FragmentCache.DiscoverPages, whose listings only
+	// see the pages already cached
+	discovering bool
+}
+
+func NewRenderContext() *RenderContext {
+	return &RenderContext{
+		Dependencies: NewDependencySet(),
+		usage:        newUsageTracker(),
+	}
+}
+
+// ReportError logs an error raised while rendering the page and keeps it so it can be shown later.
+func (r *RenderContext) ReportError(err error) {
+	if !r.quiet {
+		log.Error(err)
+	}
+	r.Errors = append(r.Errors, err)
+
+	// Errors have to be reported again whenever the page is rendered
+	r.MarkUncacheable()
+}
+
+// ReportWarningOnce reports a warning unless a warning with the same key was already reported
+// for the page.
+func (r *RenderContext) ReportWarningOnce(key string, err error) {
+	if r.warned == nil {
+		r.warned = make(map[string]bool)
+	}
+	if r.warned[key] {
+		return
+	}
+	r.warned[key] = true
+	r.ReportWarning(err)
+}
+
+// ReportWarning logs a problem that does not stop the page from being rendered and keeps it.
+func (r *RenderContext) ReportWarning(err error) {
+	if !r.quiet {
+		log.Warn(err)
+	}
+	r.Warnings = append(r.Warnings, err)
+	r.MarkUncacheable()
+}
+
 type Fragment struct {
 	Name          string
 	Type          FragmentType
+	Path          string // The .frag file the fragment was read from
 	Code          string
 	Depth         int
 	Parent        *Fragment
@@ -53,6 +154,23 @@ type Fragment struct {
 	Template      *Fragment
 	FragmentCache *FragmentCache
 	Config        *Config
+	Render        *RenderContext
+
+	source       *Source
+	templateLine int // Line of the Lua section that called setTemplate
+
+	// expects holds what the fragment declared with this:expects, by name
+	expects     map[string]*expectation
+	expectsLine int
+
+	props []string // Names of the props passed to the fragment
+
+	// dependencies holds what the fragment read while it was last evaluated, including through the
+	// fragments it included, so that pages reading it through the fragments module depend on them too
+	dependencies *DependencySet
+
+	// loopVars holds the variables of the %{for} loops being evaluated, by name
+	loopVars *CoreTable
 }
 
 func (f *Fragment) MakeChild(name string, code string) *Fragment {
@@ -67,7 +185,26 @@ func (f *Fragment) MakeChild(name string, code string) *Fragment {
 		Builders:      NewEmptyCoreTable(),
 		FragmentCache: f.FragmentCache,
 		Config:        f.Config,
+		Render:        f.Render,
+	}
+}
+
+// snapshot returns a detached copy of the fragment's evaluated state, safe to hand to other pages.
+func (f *Fragment) snapshot() *Fragment {
+	snap := *f
+	snap.Parent = nil
+	snap.Template = nil
+	snap.LocalMeta = *f.LocalMeta.clone().(*CoreTable)
+	if f.SharedMeta != nil {
+		snap.SharedMeta = f.SharedMeta.clone().(*CoreTable)
 	}
+	if f.Builders != nil {
+		snap.Builders = f.Builders.clone().(*CoreTable)
+	}
+	// Snapshots are read by other pages, so they do not record into this page's render
+	snap.Render = NewRenderContext()
+	snap.dependencies = f.dependencies.clone()
+	return &snap
 }
 
 func (f *Fragment) RetrieveSharedMetadata() *CoreTable {
@@ -98,33 +235,43 @@ func (f *Fragment) MakeLFragment() *LFragment {
 	}
 }
 
-func GetFragmentFromName(name string, fragType FragmentType, cache *FragmentCache) *Fragment {
-	// TODO: determine where a good root for the fragments are, currently just the same directory where run
-
-	// Depending on the type of fragment, get the directory specified in the config
-	var rd string
+// fragmentDir returns the directory, relative to the site root, that holds fragments of the given type.
+func fragmentDir(cfg *Config, fragType FragmentType) string {
 	switch fragType {
-	case FRAGMENT:
-		rd = cache.Config.FragmentsPath
 	case PAGE:
-		rd = cache.Config.PagePath
-	case TEMPLATE:
-		rd = cache.Config.FragmentsPath
+		return cfg.PagePath
+	default:
+		return cfg.FragmentsPath
 	}
+}
 
-	// Build full path to fragment file using config site root and paths
-	fullPath := filepath.Join(cache.Config.SiteRoot, rd, name+".frag")
+// GetFragmentFromName reads the fragment of the given type and name. If its file does not exist,
+// the error is a *FragmentNotFoundError suggesting the names of similar fragments.
+func GetFragmentFromName(name string, fragType FragmentType, cache *FragmentCache) (*Fragment, error) {
+	// Build full path to fragment file using config site root and the directory for the fragment type
+	fullPath := filepath.Join(cache.Config.SiteRoot, fragmentDir(cache.Config, fragType), name+".frag")
 
-	b, err := os.ReadFile(fullPath)
+	src, err := cache.sources.load(fullPath)
 	if err != nil {
-		panic(err)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, &FragmentNotFoundError{
+				Name:        name,
+				Type:        fragType,
+				Path:        fullPath,
+				Suggestions: suggestNames(name, cache.fragmentNames(fragType)),
+				Err:         err,
+			}
+		}
+		return nil, err
 	}
 
 	// create a new fragment
 	return &Fragment{
 		Name:          name,
 		Type:          fragType,
-		Code:          string(b),
+		Path:          fullPath,
+		Code:          src.Code,
+		source:        src,
 		Depth:         0,
 		Parent:        nil,
 		LocalMeta:     *NewEmptyCoreTable(),
@@ -132,10 +279,15 @@ func GetFragmentFromName(name string, fragType FragmentType, cache *FragmentCach
 		Builders:      NewEmptyCoreTable(),
 		FragmentCache: cache,
 		Config:        cache.Config,
-	}
+		Render:        NewRenderContext(),
+	}, nil
 }
 
+// GetAll returns the cached fragments of the given type, keyed by name.
 func (c *FragmentCache) GetAll(fragType FragmentType) map[string]*Fragment {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
 	result := make(map[string]*Fragment)
 	for name, f := range c.Cache {
 		if f.Type == fragType {
@@ -145,43 +297,141 @@ func (c *FragmentCache) GetAll(fragType FragmentType) map[string]*Fragment {
 	return result
 }
 
-func (c *FragmentCache) Get(name string, fragType FragmentType) *Fragment {
-	if f, ok := (c.Cache)[name]; ok {
-		return f
-	}
-	f := GetFragmentFromName(name, fragType, c)
-	if f == nil {
-		log.Error("Fragment not found", "name", name)
-		return nil
+func (c *FragmentCache) lookup(name string) (*Fragment, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	f, ok := c.Cache[name]
+	return f, ok
+}
+
+// Get returns the cached fragment with the given name, evaluating it first if it is not cached yet.
+// What the fragment read while it was evaluated is recorded as dependencies of render, which may be
+// nil.
+func (c *FragmentCache) Get(name string, fragType FragmentType, render *RenderContext) (*Fragment, error) {
+	f, ok := c.lookup(name)
+	if !ok {
+		var err error
+		if f, err = GetFragmentFromName(name, fragType, c); err != nil {
+			return nil, err
+		}
+
+		// Pages only need their metadata; fragments are evaluated fully
+		if fragType == PAGE {
+			f.EvaluateMeta()
+		} else {
+			f.Evaluate()
+		}
 	}
 
-	f.Evaluate()
-	return f
+	if render != nil {
+		for _, dep := range f.dependencies.List() {
+			render.AddDependency(dep)
+		}
+	}
+	return f, nil
 }
 
+// Add stores a snapshot of f under name.
 func (c *FragmentCache) Add(name string, f *Fragment) {
 	if c == nil {
 		// cannot initialize a nil receiver; just return to avoid panic
 		return
 	}
+	var snap *Fragment
+	if f != nil {
+		snap = f.snapshot()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.Cache == nil {
 		c.Cache = make(map[string]*Fragment)
 	}
 	if c.Config == nil && f != nil {
 		c.Config = f.Config
 	}
-	c.Cache[name] = f
+	c.Cache[name] = snap
+}
+
+// DiscoverPages evaluates the pages under prefix that are not cached yet, so that listings made
+// while rendering with render can see them. It does nothing unless LazyPages is set. Pages evaluated
+// here do not discover further pages themselves, which keeps listings that include each other from
+// recursing forever.
+func (c *FragmentCache) DiscoverPages(prefix string, render *RenderContext) {
+	if c == nil || !c.LazyPages || (render != nil && render.discovering) {
+		return
+	}
+
+	pageDir := filepath.Join(c.Config.SiteRoot, c.Config.PagePath)
+	err := filepath.WalkDir(pageDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || filepath.Ext(path) != ".frag" {
+			return nil
+		}
+		rel, err := filepath.Rel(pageDir, path)
+		if err != nil {
+			return nil
+		}
+		name := strings.TrimSuffix(filepath.ToSlash(rel), ".frag")
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		if _, ok := c.lookup(name); ok {
+			return nil
+		}
+		page, err := GetFragmentFromName(name, PAGE, c)
+		if err != nil {
+			log.Error("Error discovering page", "name", name, "error", err)
+			return nil
+		}
+		page.Render.discovering = true
+		page.EvaluateMeta()
+		return nil
+	})
+	if err != nil {
+		log.Error("Error discovering pages", "path", pageDir, "error", err)
+	}
+}
+
+func (c *FragmentCache) Remove(name string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.Cache, name)
 }
 
-func (f *Fragment) NewChildFragmentFromName(name string) *Fragment {
-	// TODO: determine where a good root for the fragments are, currently just the same directory where run
+// sortedNames returns the names of the given fragments in sorted order, so that listings are built
+// the same way on every run.
+func sortedNames(fragments map[string]*Fragment) []string {
+	names := make([]string, 0, len(fragments))
+	for name := range fragments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
 
-	nf := GetFragmentFromName(name, FRAGMENT, f.FragmentCache)
+func (f *Fragment) NewChildFragmentFromName(name string) (*Fragment, error) {
+	// The page depends on the fragment even if it does not exist yet, so that creating it rebuilds the page
+	f.Render.AddDependency(Dependency{DEP_FRAGMENT, name})
+	f.FragmentCache.graph.addEdge(f, Dependency{DEP_FRAGMENT, name}, "include")
+
+	nf, err := GetFragmentFromName(name, FRAGMENT, f.FragmentCache)
+	if err != nil {
+		return nil, err
+	}
 
 	// Set the parent of the new fragment to this fragment
 	nf.Parent = f
 
-	return nf
+	// The new fragment is rendered as part of this fragment's page
+	nf.Render = f.Render
+
+	return nf, nil
 }
 
 /*
@@ -202,41 +452,44 @@ Render Page:
 
 func (f *Fragment) Evaluate() string {
 	f.EvalState = PENDING
+	f.dependencies = NewDependencySet()
+
+	// The fragment evaluated first is the root of the include chain
+	if len(f.Render.includes) == 0 {
+		f.Render.includes = append(f.Render.includes, includeFrame{Fragment: f})
+		f.Render.blocks = nil
+		defer func() {
+			f.Render.includes = nil
+			// Overrides are only certain to be unused once every template ran without errors
+			if len(f.Render.Errors) == 0 {
+				f.Render.reportUnusedBlocks()
+			}
+		}()
+	}
 
 	// Setup lua state
-	L := f.CreateState()
-	defer L.Close()
-
-	cleaned := strings.TrimSpace(f.Code)
-
-	// Split fragment into lua and code parts, separated by '~~~'
-	parts := strings.SplitN(cleaned, "~~~", 2)
-	var luaCode, code string
-	if len(parts) >= 2 {
-		luaCode = parts[0]
-		code = parts[1]
-	} else {
-		luaCode = ""
-		code = parts[0]
+	L, env, release := f.CreateState()
+	defer release()
+
+	// Evaluate lua if it's present. The fragment stays pending while it runs, since the Lua section
+	// may still set the metadata its content reads.
+	f.expects = nil
+	if err := f.runLua(L, env); err != nil {
+		f.Render.ReportError(err)
 	}
 
 	f.EvalState = EVALUATING
 
-	// Strip leading and trailing whitespace from code
-	code = strings.TrimSpace(code)
-
-	// Evaluate lua if it's present
-	if luaCode != "" {
-		err := L.DoString(luaCode)
-		if err != nil {
-			log.Error(err)
-		}
+	// A fragment that did not get what it expects would only fail further down, on a missing key
+	if !f.checkExpects() {
+		f.EvalState = EVALUATED
+		return ""
 	}
 
-	// Parse code into AST
-	nodes, err := ParseCode(code, f)
+	// Parse code into AST, or reuse the tree parsed for an earlier evaluation of the same file
+	nodes, err := f.sourceOrCode().Nodes(f)
 	if err != nil {
-		log.Error(err)
+		f.Render.ReportError(err)
 		return ""
 	}
 
@@ -245,7 +498,7 @@ func (f *Fragment) Evaluate() string {
 	for _, node := range nodes {
 		s, err := node.Evaluate(f, L)
 		if err != nil {
-			log.Error(err)
+			f.Render.ReportError(err)
 			continue
 		}
 		result.WriteString(s)
@@ -258,44 +511,109 @@ func (f *Fragment) Evaluate() string {
 
 			// Set the template's shared metadata to the fragment's shared metadata
 			f.Template.SharedMeta = f.SharedMeta
+			f.metaTracer().merge(f.Template, f, META_INHERIT, "setTemplate")
 
 			// Set ${CONTENT} in the template to the result of this fragment
 			if f.Template.LocalMeta.v == nil {
 				f.Template.LocalMeta.v = make(map[string]CoreType)
 			}
 			f.Template.LocalMeta.v["CONTENT"] = NewCoreString(result.String())
-			// Add the fragment to the cache before returning so listings can discover it
-			f.FragmentCache.Add(f.Name, f)
+			f.publish()
+
+			if err := f.Render.enterInclude(f.Template, f, f.templateLine, 0); err != nil {
+				f.Render.ReportError(err)
+				return result.String()
+			}
+			defer f.Render.leaveInclude()
+
 			// Evaluate the template
 			return f.Template.Evaluate()
 		} else {
-			log.Error("Template fragments are only allowed at the root of the fragment tree.")
+			f.Render.ReportError(errors.New("Template fragments are only allowed at the root of the fragment tree."))
 		}
 	}
 
-	// Add the fragment to the cache
-	f.FragmentCache.Add(f.Name, f)
+	f.publish()
 
 	return result.String()
 }
 
-func (f *Fragment) WithContent(content string, of *Fragment) string {
+// EvaluateMeta runs the fragment's Lua section without rendering its content and publishes the
+// resulting metadata to the cache. Every page goes through this phase before any page is
+// rendered, so listings see the complete set of pages no matter the order pages are rendered in.
+func (f *Fragment) EvaluateMeta() {
+	f.EvalState = PENDING
+	f.dependencies = NewDependencySet()
+
+	// The fragment is the root of the include chain, so that what its Lua section reads is
+	// recorded as its dependencies
+	if len(f.Render.includes) == 0 {
+		f.Render.includes = append(f.Render.includes, includeFrame{Fragment: f})
+		defer func() { f.Render.includes = nil }()
+	}
+
+	L, env, release := f.CreateState()
+	defer release()
+
+	if err := f.runLua(L, env); err != nil {
+		f.Render.ReportError(err)
+	}
+
+	f.EvalState = EVALUATED
+
+	f.FragmentCache.Add(f.Name, f)
+}
+
+// publish adds an evaluated fragment to the cache. Pages are left out: they are published by
+// EvaluateMeta, and publishing them again while rendering would make listings depend on the
+// order in which pages happen to be rendered.
+func (f *Fragment) publish() {
+	if f.Type == PAGE {
+		return
+	}
+	f.FragmentCache.Add(f.Name, f)
+}
+
+// WithContent evaluates the fragment with the content passed to it by of. The unnamed [[...]] block
+// fills ${CONTENT} if hasContent is set, the named blocks fill ${slot.name} and the props are
+// set as local metadata.
+func (f *Fragment) WithContent(content string, hasContent bool, slots, props map[string]string, of *Fragment) string {
 
 	// Merge this fragment's shared metadata with the provided fragment's shared metadata
 	f.SharedMeta.mergeMut(of.SharedMeta)
+	for name := range props {
+		// A prop is passed to this fragment in particular, so it wins over inherited shared metadata
+		delete(f.SharedMeta.v, name)
+	}
+	f.metaTracer().merge(f, of, META_MERGE, "passed with content")
 
 	// Replace ${CONTENT} in the fragment code with the content provided
 	if f.LocalMeta.v == nil {
 		f.LocalMeta.v = make(map[string]CoreType)
 	}
-	f.LocalMeta.v["CONTENT"] = NewCoreString(content)
+	if hasContent {
+		f.LocalMeta.v["CONTENT"] = NewCoreString(content)
+	}
+	if len(slots) > 0 {
+		table := make(map[string]CoreType, len(slots))
+		for name, s := range slots {
+			table[name] = NewCoreString(s)
+		}
+		f.LocalMeta.v["slot"] = NewCoreTable(table)
+	}
+	for name, v := range props {
+		f.LocalMeta.v[name] = NewCoreString(v)
+		f.props = append(f.props, name)
+	}
+	sort.Strings(f.props)
 
 	c := f.Evaluate()
 	return c
 }
 
-func (f *Fragment) CreateState() *lua.LState {
-	lf := f.MakeLFragment()
+// newLuaState creates the Lua VM a page is rendered in, with the types and libraries every
+// fragment can use. A sandboxed VM only gets the libraries that cannot have side effects.
+func newLuaState(sandbox bool) *lua.LState {
 	L := lua.NewState()
 
 	// Register fragment and fragments module types
@@ -308,18 +626,45 @@ func (f *Fragment) CreateState() *lua.LState {
 
 	// Preload standard libraries
 	libs.Preload(L)
+	if sandbox {
+		sandboxLuaState(L)
+	}
+
+	return L
+}
+
+// CreateState returns the Lua VM of the page being rendered, creating it if this is the first
+// fragment of the render, along with a fresh environment table for this fragment. Globals the
+// fragment defines end up in its environment, so they cannot leak into other fragments, while
+// reads fall through to the VM's globals. release must be called once the fragment is evaluated.
+func (f *Fragment) CreateState() (L *lua.LState, env *lua.LTable, release func()) {
+	release = func() {}
+	if f.Render.L == nil {
+		f.Render.L = newLuaState(f.FragmentCache.Sandbox)
+		setRenderOf(f.Render.L, f.Render)
+		release = func() {
+			f.Render.L.Close()
+			f.Render.L = nil
+		}
+	}
+	L = f.Render.L
+
+	env = L.NewTable()
+	mt := L.NewTable()
+	mt.RawSetString("__index", L.Get(lua.GlobalsIndex))
+	L.SetMetatable(env, mt)
 
 	// Register 'this' fragment
-	lf.registerThisFragmentAs(L, "this")
+	f.MakeLFragment().registerThisFragmentAs(L, env, "this")
 
 	// Create and register the fragments module
 	fragPath := filepath.Join(f.Config.SiteRoot, f.Config.FragmentsPath)
 	pagePath := filepath.Join(f.Config.SiteRoot, f.Config.PagePath)
-	fragmentsModule := newFragmentsModule(f.FragmentCache, fragPath, pagePath)
+	fragmentsModule := newFragmentsModule(f.FragmentCache, fragPath, pagePath, f.Render, f)
 	ud := L.NewUserData()
 	ud.Value = fragmentsModule
 	L.SetMetatable(ud, L.GetTypeMetatable(luaFragmentModuleTypeName))
-	L.SetGlobal("fragments", ud)
+	env.RawSetString("fragments", ud)
 
-	return L
+	return L, env, release
 }
@@ -1,5 +1,7 @@
 package main
 
+import "unicode/utf8"
+
 type TokenType string
 
 const (
@@ -9,6 +11,7 @@ const (
 	TOKEN_META_REF             = "META_REF"
 	TOKEN_BUILDER_REF          = "BUILDER_REF"
 	TOKEN_FRAGMENT_REF         = "FRAGMENT_REF"
+	TOKEN_DIRECTIVE            = "DIRECTIVE"
 	TOKEN_OPEN_BRACE           = "{"
 	TOKEN_CLOSE_BRACE          = "}"
 	TOKEN_DOUBLE_OPEN_BRACKET  = "[["
@@ -20,6 +23,7 @@ type Token struct {
 	Literal string
 	Line    int
 	Column  int
+	Offset  int // Byte offset of the token in the lexer's input
 }
 
 type Lexer struct {
@@ -33,17 +37,23 @@ type Lexer struct {
 }
 
 func NewLexer(input string, f *Fragment) *Lexer {
-	l := &Lexer{input: input, line: 1, column: 0, fragment: f}
+	return NewLexerAt(input, f, 1, 1)
+}
+
+// NewLexerAt creates a lexer for input that starts at line and column of the fragment's file, so
+// that tokens of a content block or section carry their position in the file.
+func NewLexerAt(input string, f *Fragment, line, column int) *Lexer {
+	l := &Lexer{input: input, line: line, column: column - 1, fragment: f}
 	l.readChar()
 	return l
 }
 
+// readChar advances to the next byte. Columns count runes, so the bytes following the first byte
+// of a multi-byte character do not advance the column.
 func (l *Lexer) readChar() {
 	if l.ch == '\n' {
 		l.line++
 		l.column = 0
-	} else {
-		l.column++
 	}
 
 	if l.readPosition >= len(l.input) {
@@ -51,10 +61,22 @@ func (l *Lexer) readChar() {
 	} else {
 		l.ch = l.input[l.readPosition]
 	}
+	if utf8.RuneStart(l.ch) {
+		l.column++
+	}
 	l.position = l.readPosition
 	l.readPosition++
 }
 
+// code returns the source shown in error snippets: the fragment's whole file when there is one,
+// since token positions are positions in that file.
+func (l *Lexer) code() string {
+	if l.fragment != nil && l.fragment.Code != "" {
+		return l.fragment.Code
+	}
+	return l.input
+}
+
 func (l *Lexer) NextToken() Token {
 	var tok Token
 
@@ -62,11 +84,12 @@ func (l *Lexer) NextToken() Token {
 
 	line := l.line
 	column := l.column
+	offset := l.position
 
 	switch l.ch {
 	case '\\':
 		ch := l.peekChar()
-		if ch == '@' || ch == '*' || ch == '$' || ch == '\\' {
+		if ch == '@' || ch == '*' || ch == '$' || ch == '%' || ch == '\\' {
 			l.readChar()
 			tok = Token{Type: TOKEN_ESCAPED_CHAR, Literal: string(ch), Line: line, Column: column}
 			l.readChar()
@@ -101,6 +124,15 @@ func (l *Lexer) NextToken() Token {
 			tok = Token{Type: TOKEN_TEXT, Literal: string(l.ch), Line: line, Column: column}
 			l.readChar()
 		}
+	case '%':
+		if l.peekChar() == '{' && l.atDirective() {
+			l.readChar()
+			l.readChar()
+			tok = Token{Type: TOKEN_DIRECTIVE, Literal: "%{", Line: line, Column: column}
+		} else {
+			tok = Token{Type: TOKEN_TEXT, Literal: string(l.ch), Line: line, Column: column}
+			l.readChar()
+		}
 	case '{':
 		tok = Token{Type: TOKEN_OPEN_BRACE, Literal: "{", Line: line, Column: column}
 		l.readChar()
@@ -125,6 +157,10 @@ func (l *Lexer) NextToken() Token {
 			tok = Token{Type: TOKEN_TEXT, Literal: string(l.ch), Line: line, Column: column}
 			l.readChar()
 		}
+	case '"', '\'':
+		// Quotes are tokens of their own, so that a reference can read a quoted prop value verbatim
+		tok = Token{Type: TOKEN_TEXT, Literal: string(l.ch), Line: line, Column: column}
+		l.readChar()
 	case 0:
 		tok = Token{Type: TOKEN_EOF, Literal: "", Line: line, Column: column}
 	default:
@@ -132,9 +168,32 @@ func (l *Lexer) NextToken() Token {
 		tok = Token{Type: TOKEN_TEXT, Literal: literal, Line: line, Column: column}
 	}
 
+	tok.Offset = offset
 	return tok
 }
 
+// directiveNames are the words that can follow %{. Anything else, like the percentages of CSS
+// keyframes in 0%{opacity:0}, is text.
+var directiveNames = map[string]bool{
+	"block": true, "if": true, "elseif": true, "else": true, "for": true, "end": true,
+}
+
+// atDirective reports whether the %{ at the current position starts a directive.
+func (l *Lexer) atDirective() bool {
+	i := l.position + 2
+	for i < len(l.input) && (l.input[i] == ' ' || l.input[i] == '\t') {
+		i++
+	}
+	start := i
+	for i < len(l.input) && l.input[i] >= 'a' && l.input[i] <= 'z' {
+		i++
+	}
+	if i < len(l.input) && l.input[i] != ' ' && l.input[i] != '\t' && l.input[i] != '\n' && l.input[i] != '}' {
+		return false
+	}
+	return directiveNames[l.input[start:i]]
+}
+
 func (l *Lexer) skipWhitespace() {
 	for l.ch == '\t' {
 		l.readChar()
@@ -150,8 +209,8 @@ func (l *Lexer) peekChar() byte {
 
 func (l *Lexer) readText() string {
 	position := l.position
-	for l.ch != '\\' && l.ch != '@' && l.ch != '*' && l.ch != '$' &&
-		l.ch != '{' && l.ch != '}' && l.ch != '[' && l.ch != ']' && l.ch != 0 {
+	for l.ch != '\\' && l.ch != '@' && l.ch != '*' && l.ch != '$' && l.ch != '%' &&
+		l.ch != '{' && l.ch != '}' && l.ch != '[' && l.ch != ']' && l.ch != '"' && l.ch != '\'' && l.ch != 0 {
 		//if l.ch == '\n' {
 		//	break
 		//}
@@ -159,3 +218,19 @@ func (l *Lexer) readText() string {
 	}
 	return l.input[position:l.position]
 }
+
+// readQuoted reads the input verbatim up to the closing quote, after an opening quote token. It
+// returns the text between the quotes and where it starts, and false if the input ends first.
+func (l *Lexer) readQuoted(quote byte) (string, sourcePos, bool) {
+	start := l.position
+	pos := sourcePos{Line: l.line, Column: l.column}
+	for l.ch != quote {
+		if l.ch == 0 {
+			return "", pos, false
+		}
+		l.readChar()
+	}
+	text := l.input[start:l.position]
+	l.readChar()
+	return text, pos, true
+}
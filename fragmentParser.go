@@ -1,7 +1,9 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"regexp"
 	"strings"
 
 	"github.com/charmbracelet/lipgloss"
@@ -25,11 +27,26 @@ type ParseError struct {
 }
 
 type EvaluationError struct {
+	Line        int
+	Column      int
+	Message     string
+	Fragment    *Fragment
+	Code        string   // The code where the error occurred
+	Cause       error    // The error that caused this one, if any
+	Suggestions []string // Names that exist and are close to a name that was not found
+}
+
+// LuaError is an error raised while compiling or running Lua code. Path and Code are those of
+// the .frag file the error was raised in, which is not necessarily the file of Fragment: a
+// builder runs in the file that defined it.
+type LuaError struct {
 	Line     int
 	Column   int
 	Message  string
 	Fragment *Fragment
-	Code     string // The code where the error occurred
+	Path     string
+	Code     string
+	Cause    error // The error returned by the Lua VM
 }
 
 func (e *ParseError) Error() string {
@@ -37,7 +54,38 @@ func (e *ParseError) Error() string {
 }
 
 func (e *EvaluationError) Error() string {
-	return formatError("Evaluation Error", e.Line, e.Column, e.Message, e.Code, e.Fragment)
+	return formatError("Evaluation Error", e.Line, e.Column, withSuggestions(e.Message, e.Suggestions), e.Code, e.Fragment)
+}
+
+func (e *EvaluationError) Unwrap() error {
+	return e.Cause
+}
+
+func (e *LuaError) Error() string {
+	return formatError(e.errorType(), e.Line, e.Column, e.Message, e.Code, e.Fragment)
+}
+
+func (e *LuaError) Unwrap() error {
+	return e.Cause
+}
+
+func (e *ParseError) HTML() string {
+	return formatErrorHTML("Parse Error", e.Line, e.Column, e.Message, e.Code, e.Fragment)
+}
+
+func (e *EvaluationError) HTML() string {
+	return formatErrorHTML("Evaluation Error", e.Line, e.Column, withSuggestions(e.Message, e.Suggestions), e.Code, e.Fragment)
+}
+
+func (e *LuaError) HTML() string {
+	return formatErrorHTML(e.errorType(), e.Line, e.Column, e.Message, e.Code, e.Fragment)
+}
+
+func (e *LuaError) errorType() string {
+	if e.Path == "" {
+		return "Lua Error"
+	}
+	return "Lua Error in " + e.Fragment.relativePath(e.Path)
 }
 
 func formatError(errorType string, line, column int, message, code string, fragment *Fragment) string {
@@ -63,23 +111,13 @@ func formatError(errorType string, line, column int, message, code string, fragm
 		Foreground(lipgloss.Color("White"))
 
 	// Error header
-	header := fmt.Sprintf("%s at line %d, column %d:", errorType, line, column)
+	header := fmt.Sprintf("%s at %s:", errorType, formatPosition(line, column))
 	sb.WriteString(headerStyle.Render(header) + "\n")
-	sb.WriteString(messageStyle.Render("  "+message) + "\n\n")
+	sb.WriteString(messageStyle.Render("  "+strings.ReplaceAll(message, "\n", "\n  ")) + "\n\n")
 
 	// Include code snippet
 	lines := strings.Split(code, "\n")
-	if line-1 < len(lines) && line-1 >= 0 {
-		// Show lines around the error line
-		startLine := line - 2
-		if startLine < 0 {
-			startLine = 0
-		}
-		endLine := line + 1
-		if endLine > len(lines) {
-			endLine = len(lines)
-		}
-
+	if startLine, endLine, ok := snippetBounds(lines, line); ok {
 		// Calculate the width needed for line numbers
 		lineNumberWidth := len(fmt.Sprintf("%d", endLine))
 
@@ -88,15 +126,18 @@ func formatError(errorType string, line, column int, message, code string, fragm
 			linePrefix := "    "
 			lineNumber := fmt.Sprintf("%*d | ", lineNumberWidth, currentLineNumber)
 			if currentLineNumber == line {
+				// Measure the padding before styling, escape codes take no room on screen
+				pointerPadding := len(fmt.Sprintf(" --> %s", lineNumber))
 				linePrefix = pointerStyle.Render(" -->")
 				lineNumber = lineNumberStyle.Bold(true).Render(lineNumber)
 				codeLine := errorLineStyle.Render(lines[i])
 				sb.WriteString(fmt.Sprintf("%s %s%s\n", linePrefix, lineNumber, codeLine))
 
 				// Generate pointer to column
-				pointerPadding := len(fmt.Sprintf("%s %s", linePrefix, lineNumber))
-				pointer := pointerStyle.Render("^")
-				sb.WriteString(fmt.Sprintf("%s%s\n", strings.Repeat(" ", pointerPadding+column-1), pointer))
+				if column > 0 {
+					pointer := pointerStyle.Render("^")
+					sb.WriteString(fmt.Sprintf("%s%s%s\n", strings.Repeat(" ", pointerPadding), pointerIndent(lines[i], column), pointer))
+				}
 			} else {
 				lineNumber = lineNumberStyle.Render(lineNumber)
 				codeLine := codeStyle.Render(lines[i])
@@ -115,6 +156,50 @@ func formatError(errorType string, line, column int, message, code string, fragm
 	return sb.String()
 }
 
+// pointerIndent returns the whitespace that lines a pointer up with a column of line. Tabs are
+// kept, so the pointer lands under the right character whatever the tab width.
+func pointerIndent(line string, column int) string {
+	var sb strings.Builder
+	n := 0
+	for _, r := range line {
+		if n >= column-1 {
+			break
+		}
+		if r == '\t' {
+			sb.WriteRune('\t')
+		} else {
+			sb.WriteRune(' ')
+		}
+		n++
+	}
+	return sb.String()
+}
+
+// formatPosition formats a position for an error header. Lua runtime errors only know the line.
+func formatPosition(line, column int) string {
+	if column > 0 {
+		return fmt.Sprintf("line %d, column %d", line, column)
+	}
+	return fmt.Sprintf("line %d", line)
+}
+
+// snippetBounds returns the range of lines shown around an error: the line before it, the line
+// itself and the line after it.
+func snippetBounds(lines []string, line int) (start, end int, ok bool) {
+	if line-1 >= len(lines) || line-1 < 0 {
+		return 0, 0, false
+	}
+	start = line - 2
+	if start < 0 {
+		start = 0
+	}
+	end = line + 1
+	if end > len(lines) {
+		end = len(lines)
+	}
+	return start, end, true
+}
+
 func getFragmentStack(f *Fragment) []*Fragment {
 	var stack []*Fragment
 	for f != nil {
@@ -150,25 +235,65 @@ func (n *TextNode) Column() int {
 }
 
 type MetaReferenceNode struct {
-	Key    string
-	line   int
-	column int
+	Key      string
+	Fallback string // Content of the [[...]] block rendered when the key is not set, as in ${key[[fallback]]}
+	Nodes    []Node // Fallback parsed ahead of time, nil if it failed to parse
+	line     int
+	column   int
+
+	hasFallback bool
+	fallbackPos sourcePos // Where Fallback starts in the fragment's file
 }
 
-func (n *MetaReferenceNode) Evaluate(f *Fragment, _ *lua.LState) (string, error) {
+func (n *MetaReferenceNode) Evaluate(f *Fragment, L *lua.LState) (string, error) {
+	// The variable of a %{for} loop hides metadata of the same name
+	if value, ok := f.loopValue(n.Key); ok {
+		if _, isNil := value.(*CoreNil); isNil {
+			if n.hasFallback {
+				return evaluateContent(f, L, n.Fallback, n.Nodes, n.fallbackPos, n.line, n.column, fmt.Sprintf("the default of ${%s}", n.Key))
+			}
+			return "", &EvaluationError{
+				Line:        n.Line(),
+				Column:      n.Column(),
+				Message:     fmt.Sprintf("Metadata key not found: `%s`", n.Key),
+				Fragment:    f,
+				Code:        f.Code,
+				Suggestions: suggestNames(n.Key, metaKeys(f.loopVars)),
+			}
+		}
+		return value.stringRepresentation(), nil
+	}
+
 	// Support nested keys like "site.title" by checking both shared and local meta
+	f.Render.ReadSharedMeta(n.Key)
 	value := getNestedValue(f.SharedMeta, n.Key)
+	local := getNestedValue(&f.LocalMeta, n.Key)
+	f.metaTracer().read(f, n, value, local)
 	if _, isNil := value.(*CoreNil); isNil {
-		value = getNestedValue(&f.LocalMeta, n.Key)
+		value = local
+	} else if _, isNil := local.(*CoreNil); !isNil && local.stringRepresentation() != value.stringRepresentation() {
+		f.Render.ReportWarningOnce(fmt.Sprintf("shadow:%s:%d:%d", f.Path, n.line, n.column), &LintWarning{
+			Rule:     RULE_SHADOWED_META,
+			Path:     f.displayPath(),
+			Line:     n.line,
+			Column:   n.column,
+			Message:  fmt.Sprintf("`%s` is set in both local and shared metadata; the shared value %q is used and the local value %q is ignored", n.Key, value.stringRepresentation(), local.stringRepresentation()),
+			Fragment: f,
+			Code:     f.Code,
+		})
 	}
 
 	if _, isNil := value.(*CoreNil); isNil {
+		if n.hasFallback {
+			return evaluateContent(f, L, n.Fallback, n.Nodes, n.fallbackPos, n.line, n.column, fmt.Sprintf("the default of ${%s}", n.Key))
+		}
 		return "", &EvaluationError{
-			Line:     n.Line(),
-			Column:   n.Column(),
-			Message:  fmt.Sprintf("Metadata key not found: `%s`", n.Key),
-			Fragment: f,
-			Code:     f.Code,
+			Line:        n.Line(),
+			Column:      n.Column(),
+			Message:     fmt.Sprintf("Metadata key not found: `%s`", n.Key),
+			Fragment:    f,
+			Code:        f.Code,
+			Suggestions: suggestNames(n.Key, metaKeys(f.SharedMeta, &f.LocalMeta)),
 		}
 	}
 	return value.stringRepresentation(), nil
@@ -185,72 +310,76 @@ func (n *MetaReferenceNode) Column() int {
 type BuilderReferenceNode struct {
 	Name    string
 	Content string // Parsed and evaluated content
+	Nodes   []Node // Content parsed ahead of time, nil if it failed to parse
+	Props   []*Prop
 	line    int
 	column  int
+
+	contentPos sourcePos // Where Content starts in the fragment's file
 }
 
 func (n *BuilderReferenceNode) Evaluate(f *Fragment, L *lua.LState) (string, error) {
 	builder := f.Builders.v[n.Name]
 	if builder == nil {
 		return "", &EvaluationError{
-			Line:     n.Line(),
-			Column:   n.Column(),
-			Message:  fmt.Sprintf("Builder not found: %s", n.Name),
-			Fragment: f,
-			Code:     f.Code,
+			Line:        n.Line(),
+			Column:      n.Column(),
+			Message:     fmt.Sprintf("Builder not found: `%s`", n.Name),
+			Fragment:    f,
+			Code:        f.Code,
+			Suggestions: suggestNames(n.Name, f.Builders.keys()),
 		}
 	}
 
 	var content string
 	if n.Content != "" {
-		// Parse and evaluate the content
-		contentNodes, err := ParseCode(n.Content, f)
+		var err error
+		content, err = evaluateContent(f, L, n.Content, n.Nodes, n.contentPos, n.line, n.column, "builder "+n.Name)
 		if err != nil {
-			return "", &EvaluationError{
-				Line:     n.line,
-				Column:   n.column,
-				Message:  fmt.Sprintf("Error parsing content in builder %s: %v", n.Name, err),
-				Fragment: f,
-				Code:     f.Code,
-			}
+			return "", err
 		}
-		var contentBuilder strings.Builder
-		for _, node := range contentNodes {
-			s, err := node.Evaluate(f, L)
-			if err != nil {
+	}
 
-				return "", &EvaluationError{
-					Line:     node.Line(),
-					Column:   node.Column(),
-					Message:  fmt.Sprintf("Error evaluating content node in builder %s: %v", n.Name, err),
-					Fragment: f,
-					Code:     f.Code,
-				}
-			}
-			contentBuilder.WriteString(s)
-		}
-		content = contentBuilder.String()
+	props, err := evaluateProps(f, L, n.Props, n.line, n.column, "builder "+n.Name)
+	if err != nil {
+		return "", err
 	}
 
-	// Prepare arguments for Lua function
+	// Prepare arguments for Lua function: the content, then the props if there are any
 	args := []lua.LValue{}
 	if content != "" {
 		args = append(args, lua.LString(content))
 	}
+	if props != nil {
+		if content == "" {
+			args = append(args, lua.LNil)
+		}
+		table := L.NewTable()
+		for name, v := range props {
+			table.RawSetString(name, lua.LString(v))
+		}
+		args = append(args, table)
+	}
+
+	if fn, ok := builder.(*CoreFunction); ok && f.Render != nil {
+		f.Render.CallBuilder(fn.v)
+	}
 
-	err := L.CallByParam(lua.P{
+	err = L.CallByParam(lua.P{
 		Fn:      builder.luaType(L),
 		NRet:    1,
 		Protect: true,
 	}, args...)
 
 	if err != nil {
+		le := f.luaError(err)
 		return "", &EvaluationError{
 			Line:     n.line,
 			Column:   n.column,
-			Message:  fmt.Sprintf("Error calling builder function %s: %v", n.Name, err),
+			Message:  fmt.Sprintf("Error calling builder function %s: %v", n.Name, le),
 			Fragment: f,
 			Code:     f.Code,
+			Cause:    le,
 		}
 	}
 	ret := L.Get(-1) // returned value
@@ -270,43 +399,157 @@ func (n *BuilderReferenceNode) Column() int {
 type FragmentReferenceNode struct {
 	Name    string
 	Content string // Parsed and evaluated content
+	Nodes   []Node // Content parsed ahead of time, nil if it failed to parse
+	Slots   []*Slot
+	Props   []*Prop
 	line    int
 	column  int
+
+	contentPos sourcePos // Where Content starts in the fragment's file
+}
+
+// Slot is a named block of content passed to a fragment, like header[[...]] in
+// @{card header[[...]]}. The fragment reads it as ${slot.header}.
+type Slot struct {
+	Name    string
+	Content string
+	Nodes   []Node // Content parsed ahead of time, nil if it failed to parse
+
+	pos sourcePos // Where Content starts in the fragment's file
+}
+
+// Prop is a named value passed to a fragment or builder, like title="Hello" in
+// @{card title="Hello"}. The value can contain references, which are evaluated where the prop is
+// written. A fragment reads the prop as ${title}; a builder gets it in its props table.
+type Prop struct {
+	Name  string
+	Value string
+	Nodes []Node // Value parsed ahead of time, nil if it failed to parse
+
+	pos sourcePos // Where Value starts in the fragment's file
+}
+
+// parseProps parses the values of props ahead of time.
+func parseProps(props []*Prop, f *Fragment) {
+	for _, prop := range props {
+		prop.Nodes = parseNested(prop.Value, f, prop.pos)
+	}
+}
+
+// evaluateProps evaluates the values of the props passed to the reference at line and column of
+// f. It returns nil if there are none.
+func evaluateProps(f *Fragment, L *lua.LState, props []*Prop, line, column int, of string) (map[string]string, error) {
+	if len(props) == 0 {
+		return nil, nil
+	}
+	values := make(map[string]string, len(props))
+	for _, prop := range props {
+		if prop.Value == "" {
+			values[prop.Name] = ""
+			continue
+		}
+		v, err := evaluateContent(f, L, prop.Value, prop.Nodes, prop.pos, line, column, fmt.Sprintf("prop %s of %s", prop.Name, of))
+		if err != nil {
+			return nil, err
+		}
+		values[prop.Name] = v
+	}
+	return values, nil
 }
 
 func (n *FragmentReferenceNode) Evaluate(f *Fragment, L *lua.LState) (string, error) {
-	childFragment := f.NewChildFragmentFromName(n.Name)
+	childFragment, err := f.NewChildFragmentFromName(n.Name)
+	if err != nil {
+		return "", n.includeError(f, err)
+	}
+	// Content is evaluated here, where the references in it were written, and before the fragment
+	// joins the include chain: content that includes the same fragment again is not a cycle
+	var slots map[string]string
+	for _, slot := range n.Slots {
+		s, err := evaluateContent(f, L, slot.Content, slot.Nodes, slot.pos, n.line, n.column, fmt.Sprintf("slot %s of fragment %s", slot.Name, n.Name))
+		if err != nil {
+			return "", err
+		}
+		if slots == nil {
+			slots = make(map[string]string, len(n.Slots))
+		}
+		slots[slot.Name] = s
+	}
+
+	props, err := evaluateProps(f, L, n.Props, n.line, n.column, "fragment "+n.Name)
+	if err != nil {
+		return "", err
+	}
+	f.metaTracer().prop(childFragment, f, props, n.line, n.column)
+
+	var content string
 	if n.Content != "" {
-		// Parse and evaluate the content
-		contentNodes, err := ParseCode(n.Content, f)
+		content, err = evaluateContent(f, L, n.Content, n.Nodes, n.contentPos, n.line, n.column, "fragment "+n.Name)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if err := f.Render.enterInclude(childFragment, f, n.line, n.column); err != nil {
+		return "", err
+	}
+	defer f.Render.leaveInclude()
+	return childFragment.Invoke(content, n.Content != "", slots, props, f), nil
+}
+
+// evaluateContent evaluates content passed in a [[...]] block of the reference at line and column
+// of f. nodes is the content parsed ahead of time; if it is nil the content is parsed again to get
+// the error. where describes the block in error messages, like "builder name".
+func evaluateContent(f *Fragment, L *lua.LState, content string, nodes []Node, pos sourcePos, line, column int, where string) (string, error) {
+	var err error
+	if nodes == nil {
+		nodes, err = ParseCodeAt(content, f, pos)
+	}
+	if err != nil {
+		return "", &EvaluationError{
+			Line:     line,
+			Column:   column,
+			Message:  fmt.Sprintf("Error parsing content in %s: %v", where, err),
+			Fragment: f,
+			Code:     f.Code,
+			Cause:    err,
+		}
+	}
+
+	var sb strings.Builder
+	for _, node := range nodes {
+		s, err := node.Evaluate(f, L)
 		if err != nil {
 			return "", &EvaluationError{
-				Line:     n.line,
-				Column:   n.column,
-				Message:  fmt.Sprintf("Error parsing content in fragment %s: %v", n.Name, err),
+				Line:     node.Line(),
+				Column:   node.Column(),
+				Message:  fmt.Sprintf("Error evaluating content node in %s: %v", where, err),
 				Fragment: f,
 				Code:     f.Code,
+				Cause:    err,
 			}
 		}
-		var contentBuilder strings.Builder
-		for _, node := range contentNodes {
+		sb.WriteString(s)
+	}
+	return sb.String(), nil
+}
 
-			s, err := node.Evaluate(f, L)
-			if err != nil {
-				return "", &EvaluationError{
-					Line:     node.Line(),
-					Column:   node.Column(),
-					Message:  fmt.Sprintf("Error evaluating content node in fragment %s: %v", n.Name, err),
-					Fragment: f,
-					Code:     f.Code,
-				}
-			}
-			contentBuilder.WriteString(s)
-		}
-		content := contentBuilder.String()
-		return childFragment.WithContent(content, f), nil
+// includeError reports that the fragment referenced by n could not be read.
+func (n *FragmentReferenceNode) includeError(f *Fragment, err error) *EvaluationError {
+	evalErr := &EvaluationError{
+		Line:     n.line,
+		Column:   n.column,
+		Message:  err.Error(),
+		Fragment: f,
+		Code:     f.Code,
+		Cause:    err,
+	}
+	var notFound *FragmentNotFoundError
+	if errors.As(err, &notFound) {
+		evalErr.Message = fmt.Sprintf("Fragment not found: `%s`", n.Name)
+		evalErr.Suggestions = notFound.Suggestions
 	}
-	return childFragment.Evaluate(), nil
+	return evalErr
 }
 
 func (n *FragmentReferenceNode) Line() int {
@@ -317,8 +560,33 @@ func (n *FragmentReferenceNode) Column() int {
 	return n.column
 }
 
+// sourcePos is a position in a fragment's file.
+type sourcePos struct {
+	Line   int
+	Column int
+}
+
 func ParseCode(code string, f *Fragment) ([]Node, error) {
-	lexer := NewLexer(code, f)
+	return ParseCodeAt(code, f, sourcePos{Line: 1, Column: 1})
+}
+
+// ParseCodeAt parses code that starts at pos of the fragment's file, like the content section of
+// a fragment or the content of a [[...]] block, so that nodes and errors carry file positions.
+func ParseCodeAt(code string, f *Fragment, pos sourcePos) ([]Node, error) {
+	lexer := NewLexerAt(code, f, pos.Line, pos.Column)
+	nodes, end, err := parseNodes(lexer, f)
+	if err != nil {
+		return nil, err
+	}
+	if end != nil {
+		return nil, end.unexpected(lexer)
+	}
+	return nodes, nil
+}
+
+// parseNodes parses nodes up to the end of the input, or up to a directive that ends the block
+// being parsed, like %{end} or %{else}, which is returned.
+func parseNodes(lexer *Lexer, f *Fragment) ([]Node, *directive, error) {
 	var nodes []Node
 
 	for tok := lexer.NextToken(); tok.Type != TOKEN_EOF; tok = lexer.NextToken() {
@@ -331,52 +599,151 @@ func ParseCode(code string, f *Fragment) ([]Node, error) {
 
 			nodes = append(nodes, &TextNode{Text: tok.Literal, line: tok.Line, column: tok.Column})
 		case TOKEN_META_REF:
-			key, err := parseReference(lexer, tok)
+			ref, err := parseReference(lexer, tok)
 
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
-			nodes = append(nodes, &MetaReferenceNode{Key: key, line: tok.Line, column: tok.Column})
+			nodes = append(nodes, &MetaReferenceNode{Key: ref.name, Fallback: ref.content, Nodes: parseNested(ref.content, f, ref.contentPos), line: tok.Line, column: tok.Column, hasFallback: ref.hasContent, fallbackPos: ref.contentPos})
 		case TOKEN_BUILDER_REF:
-			name, content, err := parseReferenceWithContent(lexer, tok)
+			ref, err := parseReferenceWithContent(lexer, tok)
 
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
-			nodes = append(nodes, &BuilderReferenceNode{Name: name, Content: content, line: tok.Line, column: tok.Column})
+			if len(ref.slots) > 0 {
+				return nil, nil, &ParseError{
+					Line:     ref.slots[0].pos.Line,
+					Column:   ref.slots[0].pos.Column,
+					Message:  fmt.Sprintf("Builder `%s` was passed the named block `%s[[...]]`; only fragments take named blocks", ref.name, ref.slots[0].Name),
+					Fragment: f,
+					Code:     lexer.code(),
+				}
+			}
+			parseProps(ref.props, f)
+			nodes = append(nodes, &BuilderReferenceNode{Name: ref.name, Content: ref.content, Nodes: parseNested(ref.content, f, ref.contentPos), Props: ref.props, line: tok.Line, column: tok.Column, contentPos: ref.contentPos})
 		case TOKEN_FRAGMENT_REF:
-			name, content, err := parseReferenceWithContent(lexer, tok)
+			ref, err := parseReferenceWithContent(lexer, tok)
 
 			if err != nil {
-				return nil, err
+				return nil, nil, err
+			}
+			for _, slot := range ref.slots {
+				slot.Nodes = parseNested(slot.Content, f, slot.pos)
+			}
+			for _, prop := range ref.props {
+				reserved := map[string]string{"CONTENT": "the content", "slot": "the named blocks"}[prop.Name]
+				if reserved != "" {
+					return nil, nil, &ParseError{
+						Line:     prop.pos.Line,
+						Column:   prop.pos.Column,
+						Message:  fmt.Sprintf("`%s` cannot be passed as a prop, since the fragment reads %s passed to it under that name", prop.Name, reserved),
+						Fragment: f,
+						Code:     lexer.code(),
+					}
+				}
 			}
-			nodes = append(nodes, &FragmentReferenceNode{Name: name, Content: content, line: tok.Line, column: tok.Column})
+			parseProps(ref.props, f)
+			nodes = append(nodes, &FragmentReferenceNode{Name: ref.name, Content: ref.content, Nodes: parseNested(ref.content, f, ref.contentPos), Slots: ref.slots, Props: ref.props, line: tok.Line, column: tok.Column, contentPos: ref.contentPos})
 		case TOKEN_OPEN_BRACE:
 			nodes = append(nodes, &TextNode{Text: tok.Literal, line: tok.Line, column: tok.Column})
 		case TOKEN_CLOSE_BRACE:
 			nodes = append(nodes, &TextNode{Text: tok.Literal, line: tok.Line, column: tok.Column})
+		case TOKEN_DIRECTIVE:
+			d, err := parseDirective(lexer, tok)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch d.name() {
+			case "block":
+				node, err := parseBlock(lexer, f, d)
+				if err != nil {
+					return nil, nil, err
+				}
+				nodes = append(nodes, node)
+			case "if":
+				node, err := parseIf(lexer, f, d)
+				if err != nil {
+					return nil, nil, err
+				}
+				nodes = append(nodes, node)
+			case "for":
+				node, err := parseFor(lexer, f, d)
+				if err != nil {
+					return nil, nil, err
+				}
+				nodes = append(nodes, node)
+			case "end", "else":
+				if len(d.words) > 1 {
+					return nil, nil, &ParseError{
+						Line:     d.line,
+						Column:   d.column,
+						Message:  fmt.Sprintf("`%%{%s}` takes nothing after its name", d.name()),
+						Fragment: f,
+						Code:     lexer.code(),
+					}
+				}
+				return nodes, d, nil
+			case "elseif":
+				return nodes, d, nil
+			default:
+				return nil, nil, &ParseError{
+					Line:     d.line,
+					Column:   d.column,
+					Message:  fmt.Sprintf("Unknown directive `%%{%s}`", strings.Join(d.words, " ")),
+					Fragment: f,
+					Code:     lexer.code(),
+				}
+			}
 		default:
-			return nil, &ParseError{
+			return nil, nil, &ParseError{
 				Line:     tok.Line,
 				Column:   tok.Column,
 				Message:  fmt.Sprintf("Unknown token type: %s", tok.Type),
 				Fragment: f,
-				Code:     code,
+				Code:     lexer.code(),
 			}
 		}
 	}
 
-	return nodes, nil
+	return nodes, nil, nil
+}
+
+// parseNested parses the content passed to a builder or fragment reference ahead of time, so that
+// it is not parsed again every time the reference is evaluated. If the content does not parse, nil
+// is returned and the error is reported when the reference is evaluated.
+func parseNested(content string, f *Fragment, pos sourcePos) []Node {
+	if content == "" {
+		return nil
+	}
+	nodes, err := ParseCodeAt(content, f, pos)
+	if err != nil {
+		return nil
+	}
+	return nodes
+}
+
+// reference is a parsed ${...}, *{...} or @{...} reference.
+type reference struct {
+	name       string
+	content    string // Content of the unnamed [[...]] block
+	contentPos sourcePos
+	hasContent bool
+	slots      []*Slot // Named blocks, in the order they were written
+	props      []*Prop // Props, in the order they were written
 }
 
-func parseReference(lexer *Lexer, startToken Token) (string, error) {
+// slotName matches the names of named blocks and props.
+var slotName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// parseReference parses a meta reference: a key, optionally followed by a [[...]] block with the
+// content to render when the key is not set.
+func parseReference(lexer *Lexer, startToken Token) (*reference, error) {
+	ref := &reference{}
 	var key strings.Builder
 	braceCount := 1
-	startLine := startToken.Line
-	startColumn := startToken.Column
 
 	for {
-
 		tok := lexer.NextToken()
 		if tok.Type == TOKEN_OPEN_BRACE {
 			braceCount++
@@ -387,96 +754,271 @@ func parseReference(lexer *Lexer, startToken Token) (string, error) {
 				break
 			}
 			key.WriteString(tok.Literal)
+		} else if tok.Type == TOKEN_DOUBLE_OPEN_BRACKET && !ref.hasContent {
+			content, contentPos, err := parseContent(lexer, tok)
+			if err != nil {
+				return nil, err
+			}
+			ref.content, ref.contentPos, ref.hasContent = content, contentPos, true
 		} else if tok.Type == TOKEN_EOF {
-			return "", &ParseError{
-				Line:     startLine,
-				Column:   startColumn,
-				Message:  "Unexpected EOF while parsing reference",
-				Fragment: lexer.fragment,
-				Code:     lexer.input,
+			return nil, unexpectedEOF(lexer, startToken)
+		} else if ref.hasContent {
+			if strings.TrimSpace(tok.Literal) != "" {
+				return nil, unexpectedText(lexer, tok, "after the default content of a meta reference")
 			}
 		} else {
 			key.WriteString(tok.Literal)
 		}
 	}
 
-	return key.String(), nil
+	ref.name = key.String()
+	if ref.hasContent {
+		ref.name = strings.TrimSpace(ref.name)
+	}
+	return ref, nil
 }
 
-func parseReferenceWithContent(lexer *Lexer, startToken Token) (string, string, error) {
-
-	var nameBuilder strings.Builder
+// parseReferenceWithContent parses a builder or fragment reference: a name followed by an unnamed
+// [[...]] block, whose content fills ${CONTENT}, any number of named blocks like header[[...]]
+// and any number of props like title="Hello", in any order.
+func parseReferenceWithContent(lexer *Lexer, startToken Token) (*reference, error) {
+	ref := &reference{}
+	haveName := false
 	braceCount := 1
-	startLine := startToken.Line
-	startColumn := startToken.Column
+
+	// pending holds the text since the start of the reference or the end of the last block or
+	// prop, and stray the first text after it, which is an error if nothing follows it
+	var pending strings.Builder
+	var stray *Token
 
 	for {
 		tok := lexer.NextToken()
 
-		if tok.Type == TOKEN_OPEN_BRACE {
-			braceCount++
+		if tok.Type == TOKEN_TEXT && (tok.Literal == `"` || tok.Literal == "'") && braceCount == 1 {
+			before := strings.TrimSpace(pending.String())
+			if strings.HasSuffix(before, "=") {
+				words := strings.Fields(strings.TrimSuffix(before, "="))
+				if !haveName && len(words) > 0 {
+					ref.name, words, haveName = words[0], words[1:], true
+				}
+				if len(words) != 1 {
+					return nil, &ParseError{
+						Line:     tok.Line,
+						Column:   tok.Column,
+						Message:  fmt.Sprintf("Invalid prop `%s`: a prop is written name=\"value\", with a name made of letters, digits, _ and -", strings.Join(words, " ")+"="),
+						Fragment: lexer.fragment,
+						Code:     lexer.code(),
+					}
+				}
+				if err := ref.addProp(lexer, words[0], tok); err != nil {
+					return nil, err
+				}
+				pending.Reset()
+				stray = nil
+				continue
+			}
+		}
 
-			nameBuilder.WriteString(tok.Literal)
-		} else if tok.Type == TOKEN_CLOSE_BRACE {
+		switch tok.Type {
+		case TOKEN_OPEN_BRACE:
+			braceCount++
+			pending.WriteString(tok.Literal)
+		case TOKEN_CLOSE_BRACE:
 			braceCount--
-
-			if braceCount == 0 {
-
-				break
+			if braceCount > 0 {
+				pending.WriteString(tok.Literal)
+				continue
+			}
+			if !haveName {
+				ref.name = strings.TrimSpace(pending.String())
+			} else if stray != nil {
+				return nil, unexpectedText(lexer, *stray, "at the end of the reference")
+			}
+			return ref, nil
+		case TOKEN_DOUBLE_OPEN_BRACKET:
+			words := strings.Fields(pending.String())
+			pending.Reset()
+			stray = nil
+			if !haveName {
+				if len(words) == 0 {
+					return nil, &ParseError{
+						Line:     tok.Line,
+						Column:   tok.Column,
+						Message:  "Missing name before [[",
+						Fragment: lexer.fragment,
+						Code:     lexer.code(),
+					}
+				}
+				ref.name, words, haveName = words[0], words[1:], true
 			}
-			nameBuilder.WriteString(tok.Literal)
-		} else if tok.Type == TOKEN_DOUBLE_OPEN_BRACKET {
 
-			content, err := parseContent(lexer, tok)
+			content, contentPos, err := parseContent(lexer, tok)
 			if err != nil {
+				return nil, err
+			}
 
-				return "", "", err
+			switch {
+			case len(words) == 0 && !ref.hasContent:
+				ref.content, ref.contentPos, ref.hasContent = content, contentPos, true
+			case len(words) == 0:
+				return nil, &ParseError{
+					Line:     tok.Line,
+					Column:   tok.Column,
+					Message:  fmt.Sprintf("`%s` is passed more than one unnamed [[...]] block", ref.name),
+					Fragment: lexer.fragment,
+					Code:     lexer.code(),
+				}
+			case len(words) == 1 && slotName.MatchString(words[0]):
+				for _, slot := range ref.slots {
+					if slot.Name == words[0] {
+						return nil, &ParseError{
+							Line:     tok.Line,
+							Column:   tok.Column,
+							Message:  fmt.Sprintf("`%s` is passed the block `%s[[...]]` more than once", ref.name, words[0]),
+							Fragment: lexer.fragment,
+							Code:     lexer.code(),
+						}
+					}
+				}
+				ref.slots = append(ref.slots, &Slot{Name: words[0], Content: content, pos: contentPos})
+			default:
+				return nil, &ParseError{
+					Line:     tok.Line,
+					Column:   tok.Column,
+					Message:  fmt.Sprintf("Invalid block name `%s`: a named block is written name[[...]], with a name made of letters, digits, _ and -", strings.Join(words, " ")),
+					Fragment: lexer.fragment,
+					Code:     lexer.code(),
+				}
+			}
+		case TOKEN_EOF:
+			return nil, unexpectedEOF(lexer, startToken)
+		default:
+			if stray == nil && strings.TrimSpace(tok.Literal) != "" {
+				t := tok
+				stray = &t
 			}
+			pending.WriteString(tok.Literal)
+		}
+	}
+}
+
+// addProp reads the quoted value of the prop name, whose opening quote is quote.
+func (ref *reference) addProp(lexer *Lexer, name string, quote Token) error {
+	propError := func(message string) error {
+		return &ParseError{
+			Line:     quote.Line,
+			Column:   quote.Column,
+			Message:  message,
+			Fragment: lexer.fragment,
+			Code:     lexer.code(),
+		}
+	}
+	if !slotName.MatchString(name) {
+		return propError(fmt.Sprintf("Invalid prop `%s=`: a prop is written name=\"value\", with a name made of letters, digits, _ and -", name))
+	}
+	for _, prop := range ref.props {
+		if prop.Name == name {
+			return propError(fmt.Sprintf("`%s` is passed the prop `%s` more than once", ref.name, name))
+		}
+	}
 
-			// Consume any remaining tokens until the closing brace
-			for {
-				tok := lexer.NextToken()
+	value, pos, ok := lexer.readQuoted(quote.Literal[0])
+	if !ok {
+		return propError(fmt.Sprintf("Unexpected EOF while parsing the value of prop `%s`: missing closing %s", name, quote.Literal))
+	}
+	ref.props = append(ref.props, &Prop{Name: name, Value: value, pos: pos})
+	return nil
+}
+
+func unexpectedEOF(lexer *Lexer, startToken Token) error {
+	return &ParseError{
+		Line:     startToken.Line,
+		Column:   startToken.Column,
+		Message:  "Unexpected EOF while parsing reference",
+		Fragment: lexer.fragment,
+		Code:     lexer.code(),
+	}
+}
 
-				if tok.Type == TOKEN_CLOSE_BRACE {
-					braceCount--
+func unexpectedText(lexer *Lexer, tok Token, where string) error {
+	return &ParseError{
+		Line:     tok.Line,
+		Column:   tok.Column,
+		Message:  fmt.Sprintf("Unexpected `%s` %s", strings.TrimSpace(tok.Literal), where),
+		Fragment: lexer.fragment,
+		Code:     lexer.code(),
+	}
+}
 
-					if braceCount == 0 {
-						break
-					}
-				} else if tok.Type == TOKEN_EOF {
-					return "", "", &ParseError{
-						Line:     startLine,
-						Column:   startColumn,
-						Message:  "Unexpected EOF while parsing reference",
-						Fragment: lexer.fragment,
-						Code:     lexer.input,
-					}
-				} else {
-					nameBuilder.WriteString(tok.Literal)
-				}
+// directive is a parsed %{...} directive, like %{block head append} or %{end}.
+type directive struct {
+	words  []string
+	line   int
+	column int
+}
+
+func (d *directive) name() string {
+	if len(d.words) == 0 {
+		return ""
+	}
+	return d.words[0]
+}
+
+// unexpected returns the error for a directive that ends a block where no block it could end is
+// open, like %{end} at the top level or %{elseif} in a loop.
+func (d *directive) unexpected(lexer *Lexer) error {
+	opening := "`%{block}`, `%{if}` or `%{for}`"
+	switch d.name() {
+	case "elseif":
+		opening = "`%{if}`"
+	case "else":
+		opening = "`%{if}` or `%{for}`"
+	}
+	return &ParseError{
+		Line:     d.line,
+		Column:   d.column,
+		Message:  fmt.Sprintf("`%%{%s}` without a matching %s", strings.Join(d.words, " "), opening),
+		Fragment: lexer.fragment,
+		Code:     lexer.code(),
+	}
+}
+
+// parseDirective reads a directive up to its closing brace and splits it into words.
+func parseDirective(lexer *Lexer, startToken Token) (*directive, error) {
+	var text strings.Builder
+	braceCount := 1
+
+	for {
+		tok := lexer.NextToken()
+		if tok.Type == TOKEN_OPEN_BRACE {
+			braceCount++
+		} else if tok.Type == TOKEN_CLOSE_BRACE {
+			braceCount--
+			if braceCount == 0 {
+				break
 			}
-			return strings.TrimSpace(nameBuilder.String()), content, nil
 		} else if tok.Type == TOKEN_EOF {
-
-			return "", "", &ParseError{
-				Line:     startLine,
-				Column:   startColumn,
-				Message:  "Unexpected EOF while parsing reference",
+			return nil, &ParseError{
+				Line:     startToken.Line,
+				Column:   startToken.Column,
+				Message:  "Unexpected EOF while parsing directive",
 				Fragment: lexer.fragment,
-				Code:     lexer.input,
+				Code:     lexer.code(),
 			}
-		} else {
-
-			nameBuilder.WriteString(tok.Literal)
 		}
+		text.WriteString(tok.Literal)
 	}
 
-	return strings.TrimSpace(nameBuilder.String()), "", nil
+	return &directive{words: strings.Fields(text.String()), line: startToken.Line, column: startToken.Column}, nil
 }
 
-func parseContent(lexer *Lexer, startToken Token) (string, error) {
+// parseContent reads the content of a [[...]] block up to its matching ]]. The content is taken
+// verbatim from the input, along with the position it starts at, so that it can be parsed again
+// with the positions it has in the file.
+func parseContent(lexer *Lexer, startToken Token) (string, sourcePos, error) {
 
-	var contentBuilder strings.Builder
+	start := startToken.Offset + len(startToken.Literal)
+	pos := sourcePos{Line: startToken.Line, Column: startToken.Column + len(startToken.Literal)}
 	bracketCount := 1
 
 	for {
@@ -484,32 +1026,22 @@ func parseContent(lexer *Lexer, startToken Token) (string, error) {
 
 		if tok.Type == TOKEN_DOUBLE_OPEN_BRACKET {
 			bracketCount++
-
-			contentBuilder.WriteString(tok.Literal)
 		} else if tok.Type == TOKEN_DOUBLE_CLOSE_BRACKET {
 			bracketCount--
 
 			if bracketCount == 0 {
 
-				break
+				return lexer.input[start:tok.Offset], pos, nil
 			}
-			contentBuilder.WriteString(tok.Literal)
 		} else if tok.Type == TOKEN_EOF {
 
-			return "", &ParseError{
+			return "", sourcePos{}, &ParseError{
 				Line:     startToken.Line,
 				Column:   startToken.Column,
 				Message:  "Unexpected EOF while parsing content",
 				Fragment: lexer.fragment,
-				Code:     lexer.input,
+				Code:     lexer.code(),
 			}
-		} else {
-
-			contentBuilder.WriteString(tok.Literal)
 		}
 	}
-
-	parsedContent := contentBuilder.String()
-
-	return parsedContent, nil
 }
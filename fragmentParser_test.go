@@ -0,0 +1,138 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNamedSlots(t *testing.T) {
+	files := map[string]string{
+		"fragment/card.frag": "~~~\n<h2>${slot.title}</h2><p>${CONTENT[[no body]]}</p><footer>${slot.footer[[no footer]]}</footer>",
+		"page/index.frag":    "this:setSharedMeta { who = \"World\" }\n~~~\n@{card title[[Hello ${who}]] footer[[Bye]] [[Body]]}\n@{card title[[Only a title]]}",
+	}
+	out, d := renderPage(t, files, "index")
+	requireNoErrors(t, d)
+	want := "<h2> Hello World </h2> <p> Body </p> <footer> Bye </footer> <h2> Only a title </h2> <p> no body </p> <footer> no footer </footer>"
+	if out != want {
+		t.Errorf("got\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestMetaReferenceDefault(t *testing.T) {
+	files := map[string]string{
+		"page/index.frag": "this:setSharedMeta { set = \"yes\" }\n~~~\n<p>${set[[no]]} ${unset[[*fallback*]]}</p>",
+	}
+	out, d := renderPage(t, files, "index")
+	requireNoErrors(t, d)
+	if want := "<p> yes *fallback* </p>"; out != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+}
+
+func TestSlotParseErrors(t *testing.T) {
+	tests := []struct {
+		content string
+		message string
+	}{
+		{"@{card a[[x]] a[[y]]}", "is passed the block `a[[...]]` more than once"},
+		{"@{card [[x]] [[y]]}", "more than one unnamed [[...]] block"},
+		{"@{card bad name[[x]]}", "Invalid block name `bad name`"},
+		{"@{[[x]]}", "Missing name before [["},
+		{"@{card [[x]] junk}", "Unexpected `junk` at the end of the reference"},
+		{"*{b slot[[x]]}", "only fragments take named blocks"},
+		{"${key[[x]] junk}", "after the default content of a meta reference"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.content, func(t *testing.T) {
+			_, err := ParseCode(tt.content, nil)
+			if err == nil {
+				t.Fatalf("expected an error containing %q", tt.message)
+			}
+			if got := stripANSI(err.Error()); !strings.Contains(got, tt.message) {
+				t.Errorf("got %q, want it to contain %q", got, tt.message)
+			}
+		})
+	}
+}
+
+func TestPropsShadowSharedMeta(t *testing.T) {
+	files := map[string]string{
+		"fragment/card.frag": "~~~\n<h2>${title}</h2><a href=\"${href[[#]]}\">${CONTENT}</a>",
+		"page/index.frag":    "this:setSharedMeta { title = \"Page\", author = \"Ann\" }\n~~~\n@{card title=\"Posts by ${author}\" href='/posts/'[[Body]]}@{card [[Plain]]}",
+	}
+	out, d := renderPage(t, files, "index")
+	requireNoErrors(t, d)
+	want := "<h2> Posts by Ann </h2> <a href=\"/posts/\"> Body </a> <h2> Page </h2> <a href=\"#\"> Plain </a>"
+	if out != want {
+		t.Errorf("got\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestBuilderProps(t *testing.T) {
+	files := map[string]string{
+		"page/index.frag": "this:addBuilders {\n" +
+			"    link = function(content, props)\n" +
+			"        return \"<a href='\" .. props.href .. \"'>\" .. (props.label or content or \"?\") .. \"</a>\"\n" +
+			"    end\n" +
+			"}\n~~~\n*{link href=\"/a\" label=\"A\"}*{link href=\"/b\"[[B]]}*{link href=\"/c\"}",
+	}
+	out, d := renderPage(t, files, "index")
+	requireNoErrors(t, d)
+	if want := "<a href='/a'> A </a> <a href='/b'> B </a> <a href='/c'> ? </a>"; out != want {
+		t.Errorf("got\n%s\nwant\n%s", out, want)
+	}
+}
+
+func TestPropParseErrors(t *testing.T) {
+	tests := []struct {
+		content string
+		message string
+	}{
+		{"@{card a=\"x\" a=\"y\"}", "is passed the prop `a` more than once"},
+		{"@{card a=\"x}", "missing closing \""},
+		{"@{card CONTENT=\"x\"}", "`CONTENT` cannot be passed as a prop"},
+		{"@{card slot=\"x\"}", "`slot` cannot be passed as a prop"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.content, func(t *testing.T) {
+			_, err := ParseCode(tt.content, nil)
+			if err == nil {
+				t.Fatalf("expected an error containing %q", tt.message)
+			}
+			if got := stripANSI(err.Error()); !strings.Contains(got, tt.message) {
+				t.Errorf("got %q, want it to contain %q", got, tt.message)
+			}
+		})
+	}
+}
+
+func TestNestedContentPositionsCountRunes(t *testing.T) {
+	files := map[string]string{
+		"fragment/card.frag": "~~~\n<div>${CONTENT}</div>",
+		"page/index.frag":    "~~~\n<p>héllo</p>\n@{card [[\n  ünïcødé @{card [[✓ *{nope}]]}\n]]}",
+	}
+	_, d := renderPage(t, files, "index")
+	requireError(t, d, "Builder not found: `nope`")
+
+	for _, item := range d.Items() {
+		e, ok := item.Err.(*EvaluationError)
+		if !ok {
+			continue
+		}
+		// The outer error points at the inner include, and its innermost cause at the missing builder
+		if e.Line != 4 || e.Column != 11 {
+			t.Errorf("got line %d, column %d for the include, want line 4, column 11", e.Line, e.Column)
+		}
+		for cause, ok := e.Cause.(*EvaluationError); ok; cause, ok = e.Cause.(*EvaluationError) {
+			e = cause
+		}
+		if e.Line != 4 || e.Column != 22 {
+			t.Errorf("got line %d, column %d for the builder, want line 4, column 22", e.Line, e.Column)
+		}
+		if !strings.Contains(e.Code, "<p>héllo</p>") {
+			t.Errorf("the error does not show the code of the page: %q", e.Code)
+		}
+		return
+	}
+	t.Fatal("expected an evaluation error")
+}
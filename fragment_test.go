@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDiscoverPagesConcurrently(t *testing.T) {
+	files := map[string]string{}
+	// Every post lists the others, so discovering one page evaluates pages that list pages again
+	for i := 0; i < 8; i++ {
+		files[fmt.Sprintf("page/posts/p%d.frag", i)] = fmt.Sprintf("this:setSharedMeta { title = \"p%d\", count = #fragments:getPagesUnder(\"posts/\") }\n~~~\n<p>${title}</p>", i)
+	}
+	site, err := newOnDemandSite(writeSite(t, files))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]string, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f, err := GetFragmentFromName(fmt.Sprintf("posts/p%d", i), PAGE, site.Cache)
+			if err != nil {
+				errs[i] = err.Error()
+				return
+			}
+			if out := f.Evaluate(); !strings.Contains(out, fmt.Sprintf("p%d", i)) {
+				errs[i] = fmt.Sprintf("got %q", out)
+			}
+			for _, err := range f.Render.Errors {
+				errs[i] += err.Error()
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, e := range errs {
+		if e != "" {
+			t.Errorf("page p%d: %s", i, e)
+		}
+	}
+	if n := len(site.Cache.GetAll(PAGE)); n != 8 {
+		t.Errorf("expected every page to be discovered, got %d", n)
+	}
+}
+
+func TestSetLocalMetaInLuaDoesNotWarn(t *testing.T) {
+	files := map[string]string{
+		"fragment/card.frag": "this:setLocalMeta { label = \"card\" }\n~~~\n<p>${label}</p>",
+		"page/index.frag":    "this:setLocalMeta { title = \"Home\" }\n~~~\n<h1>${title}</h1>@{card}",
+	}
+	out, d := renderPage(t, files, "index")
+	requireNoErrors(t, d)
+	if want := "<h1> Home </h1> <p> card </p>"; out != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+	for _, item := range d.Items() {
+		if msg := item.Err.Error(); strings.Contains(msg, "partially evaluated") {
+			t.Errorf("unexpected warning %q", msg)
+		}
+	}
+}
+
+func TestFragmentGlobalsDoNotLeak(t *testing.T) {
+	files := map[string]string{
+		"fragment/a.frag": "function formatDate(s) return \"[\" .. s .. \"]\" end\n" +
+			"this:addBuilders { date = function(content) return formatDate(content) end }\n~~~\n<p>*{date[[today]]}</p>",
+		"fragment/b.frag": "this:setLocalMeta {\n" +
+			"    leaked = tostring(formatDate),\n" +
+			"    page = tostring(pageGlobal),\n" +
+			"    shared = string.upper(\"up\") .. \" \" .. require(\"strings\").trim(\" x \", \" \"),\n" +
+			"}\n~~~\n<p>${leaked} ${page} ${shared}</p>",
+		"page/index.frag": "pageGlobal = \"page\"\n~~~\n@{a}@{b}",
+	}
+	out, d := renderPage(t, files, "index")
+	requireNoErrors(t, d)
+	if want := "<p> [today] </p> <p> nil nil UP x </p>"; out != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+}
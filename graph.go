@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// GraphNode is a page, fragment or template in the dependency graph. Templates are fragments that
+// some fragment sets as its template; they live with the other fragments, so a fragment used both
+// ways is a single node. File is empty for a fragment that is referenced but does not exist.
+type GraphNode struct {
+	ID   string         `json:"id"`
+	Kind DependencyKind `json:"kind"`
+	Name string         `json:"name"`
+	File string         `json:"file,omitempty"`
+}
+
+// GraphEdge means that From read To while a page was evaluated. Via is how: "include" for an
+// @{...} reference, "setTemplate", or the fragments module function that was called.
+type GraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Via  string `json:"via"`
+}
+
+// DependencyGraph is the page → fragment → template graph written by `fragments graph`.
+type DependencyGraph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// graphRecorder collects edges while pages are evaluated. A nil recorder records nothing, which is
+// the case outside of `fragments graph`.
+type graphRecorder struct {
+	mu    sync.Mutex
+	edges map[GraphEdge]bool
+}
+
+func newGraphRecorder() *graphRecorder {
+	return &graphRecorder{edges: make(map[GraphEdge]bool)}
+}
+
+func (g *graphRecorder) addEdge(from *Fragment, dep Dependency, via string) {
+	if g == nil || from == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fromKind := DEP_FRAGMENT
+	if from.Type == PAGE {
+		fromKind = DEP_PAGE
+	}
+	g.edges[GraphEdge{From: graphID(fromKind, from.Name), To: graphID(dep.Kind, dep.Name), Via: via}] = true
+}
+
+// graphID returns the ID of the node for a dependency. Templates are read from the fragments
+// directory, so they share the ID of the fragment with the same name.
+func graphID(kind DependencyKind, name string) string {
+	if kind == DEP_TEMPLATE {
+		kind = DEP_FRAGMENT
+	}
+	return string(kind) + ":" + name
+}
+
+// Graph evaluates every page without writing anything and returns the graph of which page,
+// fragment and template read which. Listings made with getPagesUnder and getAllPages become an
+// edge to every page they return. Every fragment and template on disk is a node, even if nothing
+// reaches it.
+func (s *Site) Graph() (*DependencyGraph, *Diagnostics) {
+	s.Diagnostics = NewDiagnostics()
+	s.Cache.graph = newGraphRecorder()
+	// A memoized fragment is not evaluated again, so the fragments it reads would be missed
+	s.Cache.memo = nil
+
+	s.collectMeta(s.Pages)
+	s.forEachPage(s.Pages, func(name string, v *Fragment) {
+		v.Render.Errors = nil
+		v.Render.Warnings = nil
+		v.Evaluate()
+		s.Diagnostics.ReportPage(name, v.Render)
+	})
+
+	nodes := make(map[string]GraphNode)
+	addNode := func(kind DependencyKind, name string) {
+		id := graphID(kind, name)
+		if _, ok := nodes[id]; ok {
+			return
+		}
+		node := GraphNode{ID: id, Kind: kind, Name: name}
+		if path := s.graphFile(kind, name); path != "" {
+			node.File = siteRelativePath(s.Config, path)
+		}
+		nodes[id] = node
+	}
+	for name := range s.Pages {
+		addNode(DEP_PAGE, name)
+	}
+	for _, name := range s.Cache.fragmentNames(FRAGMENT) {
+		addNode(DEP_FRAGMENT, name)
+	}
+
+	pages := sortedNames(s.Pages)
+	edges := make(map[GraphEdge]bool)
+	for e := range s.Cache.graph.edges {
+		kind, name := splitGraphID(e.To)
+		switch kind {
+		case DEP_PAGES_UNDER, DEP_ALL_PAGES:
+			for _, page := range pages {
+				if kind == DEP_ALL_PAGES || strings.HasPrefix(page, name) {
+					edges[GraphEdge{From: e.From, To: graphID(DEP_PAGE, page), Via: e.Via}] = true
+				}
+			}
+			continue
+		}
+		addNode(kind, name)
+		edges[e] = true
+		if e.Via == "setTemplate" {
+			node := nodes[e.To]
+			node.Kind = DEP_TEMPLATE
+			nodes[e.To] = node
+		}
+	}
+
+	g := &DependencyGraph{Nodes: []GraphNode{}, Edges: []GraphEdge{}}
+	for _, node := range nodes {
+		g.Nodes = append(g.Nodes, node)
+	}
+	for e := range edges {
+		if e.From != e.To {
+			g.Edges = append(g.Edges, e)
+		}
+	}
+	sort.Slice(g.Nodes, func(i, j int) bool { return g.Nodes[i].ID < g.Nodes[j].ID })
+	sort.Slice(g.Edges, func(i, j int) bool {
+		a, b := g.Edges[i], g.Edges[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		return a.Via < b.Via
+	})
+	return g, s.Diagnostics
+}
+
+// graphFile returns the .frag file of a node, or "" if there is none.
+func (s *Site) graphFile(kind DependencyKind, name string) string {
+	var path string
+	switch kind {
+	case DEP_PAGE:
+		path = s.PageSourcePath(name)
+	case DEP_FRAGMENT:
+		path = filepath.Join(s.FragmentDir(), filepath.FromSlash(name)+".frag")
+	default:
+		return ""
+	}
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+func splitGraphID(id string) (DependencyKind, string) {
+	kind, name, _ := strings.Cut(id, ":")
+	return DependencyKind(kind), name
+}
+
+// WriteGraph writes the graph to w in the given format: "dot", "mermaid" or "json".
+func WriteGraph(w io.Writer, format string, g *DependencyGraph) error {
+	switch format {
+	case "dot":
+		return writeGraphDOT(w, g)
+	case "mermaid":
+		return writeGraphMermaid(w, g)
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(g)
+	}
+	return fmt.Errorf("unknown graph format %q (expected dot, mermaid or json)", format)
+}
+
+func writeGraphDOT(w io.Writer, g *DependencyGraph) error {
+	var sb strings.Builder
+	sb.WriteString("digraph fragments {\n")
+	sb.WriteString("  rankdir=LR;\n")
+	for _, node := range g.Nodes {
+		shape := "ellipse"
+		switch node.Kind {
+		case DEP_PAGE:
+			shape = "box"
+		case DEP_TEMPLATE:
+			shape = "component"
+		}
+		attrs := fmt.Sprintf("label=%s, shape=%s", dotQuote(node.Name), shape)
+		if node.File == "" {
+			attrs += ", style=dashed"
+		}
+		sb.WriteString(fmt.Sprintf("  %s [%s];\n", dotQuote(node.ID), attrs))
+	}
+	for _, e := range g.Edges {
+		sb.WriteString(fmt.Sprintf("  %s -> %s", dotQuote(e.From), dotQuote(e.To)))
+		if e.Via != "include" {
+			sb.WriteString(fmt.Sprintf(" [label=%s]", dotQuote(e.Via)))
+		}
+		sb.WriteString(";\n")
+	}
+	sb.WriteString("}\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// writeGraphMermaid writes a Mermaid flowchart. Node IDs are numbered, since Mermaid IDs cannot
+// contain the slashes of nested fragment names.
+func writeGraphMermaid(w io.Writer, g *DependencyGraph) error {
+	ids := make(map[string]string, len(g.Nodes))
+	var sb strings.Builder
+	sb.WriteString("flowchart LR\n")
+	for i, node := range g.Nodes {
+		id := fmt.Sprintf("n%d", i)
+		ids[node.ID] = id
+		label := mermaidQuote(string(node.Kind) + ": " + node.Name)
+		switch node.Kind {
+		case DEP_PAGE:
+			sb.WriteString(fmt.Sprintf("  %s[%s]", id, label))
+		case DEP_TEMPLATE:
+			sb.WriteString(fmt.Sprintf("  %s[[%s]]", id, label))
+		default:
+			sb.WriteString(fmt.Sprintf("  %s(%s)", id, label))
+		}
+		if node.File == "" {
+			sb.WriteString(":::missing")
+		}
+		sb.WriteString("\n")
+	}
+	for _, e := range g.Edges {
+		if e.Via == "include" {
+			sb.WriteString(fmt.Sprintf("  %s --> %s\n", ids[e.From], ids[e.To]))
+		} else {
+			sb.WriteString(fmt.Sprintf("  %s -->|%s| %s\n", ids[e.From], e.Via, ids[e.To]))
+		}
+	}
+	sb.WriteString("  classDef missing stroke-dasharray: 5 5\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func mermaidQuote(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, "#quot;") + `"`
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGraphEdges(t *testing.T) {
+	files := map[string]string{
+		"fragment/page.frag":  "~~~\n<main>${CONTENT}</main>",
+		"fragment/nav.frag":   "~~~\n<nav>nav</nav>",
+		"fragment/tools.frag": "this:addBuilders { shout = function(content) return content .. \"!\" end }\n~~~\n",
+		"page/index.frag": "this:setTemplate(\"page\")\n" +
+			"local posts = fragments:getPagesUnder(\"posts\")\n" +
+			"local tools = fragments:getBuilders(\"fragment\", \"tools\")\n~~~\n@{nav}",
+		"page/posts/a.frag": "~~~\n<p>a</p>",
+	}
+	s, err := LoadSite(writeSite(t, files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Jobs = 1
+	g, d := s.Graph()
+	requireNoErrors(t, d)
+
+	want := []GraphEdge{
+		{From: "page:index", To: "fragment:nav", Via: "include"},
+		{From: "page:index", To: "fragment:page", Via: "setTemplate"},
+		{From: "page:index", To: "fragment:tools", Via: "getBuilders"},
+		{From: "page:index", To: "page:posts/a", Via: "getPagesUnder"},
+	}
+	if !reflect.DeepEqual(g.Edges, want) {
+		t.Fatalf("got edges %+v, want %+v", g.Edges, want)
+	}
+
+	formats := map[string][]string{
+		"dot": {
+			`"page:index" -> "fragment:nav";`,
+			`"page:index" -> "fragment:page" [label="setTemplate"];`,
+			`"page:index" -> "fragment:tools" [label="getBuilders"];`,
+			`"page:index" -> "page:posts/a" [label="getPagesUnder"];`,
+			`"fragment:page" [label="page", shape=component];`,
+		},
+		// Nodes are numbered in ID order: nav, page, tools, index, posts/a
+		"mermaid": {
+			"n3 --> n0\n",
+			"n3 -->|setTemplate| n1\n",
+			"n3 -->|getBuilders| n2\n",
+			"n3 -->|getPagesUnder| n4\n",
+			`n1[["template: page"]]`,
+		},
+	}
+	for format, lines := range formats {
+		var buf bytes.Buffer
+		if err := WriteGraph(&buf, format, g); err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range lines {
+			if !strings.Contains(buf.String(), line) {
+				t.Errorf("%s output does not contain %q:\n%s", format, line, buf.String())
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WriteGraph(&buf, "json", g); err != nil {
+		t.Fatal(err)
+	}
+	var decoded DependencyGraph
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.Edges, want) {
+		t.Errorf("got JSON edges %+v, want %+v", decoded.Edges, want)
+	}
+}
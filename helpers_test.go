@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/charmbracelet/log"
+)
+
+func TestMain(m *testing.M) {
+	// runFragments runs the test binary as the fragments command
+	if args := os.Getenv("FRAGMENTS_TEST_ARGS"); args != "" {
+		os.Args = append([]string{"fragments"}, strings.Split(args, "\n")...)
+		main()
+		os.Exit(0)
+	}
+
+	// Builds log every page; tests only look at what the build returns and writes
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// writeSite writes a site with the given files, by path relative to the site root, and returns
+// the path of its config.yml.
+func writeSite(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	files["config.yml"] = "fragments: fragment\npages: page\ninclude: include\nbuild: build\n"
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(root, "include"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(root, "config.yml")
+}
+
+// buildSite loads the site at configPath and builds it with the given number of workers.
+func buildSite(t *testing.T, configPath string, jobs int) (*Site, RebuildResult) {
+	t.Helper()
+	s, err := LoadSite(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Jobs = jobs
+	return s, s.Build()
+}
+
+// readOutput returns the HTML written for a page.
+func readOutput(t *testing.T, s *Site, page string) string {
+	t.Helper()
+	data, err := os.ReadFile(s.PageOutputPath(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// requireNoErrors fails the test if the build reported errors.
+func requireNoErrors(t *testing.T, d *Diagnostics) {
+	t.Helper()
+	for _, item := range d.Items() {
+		if item.Severity == SEVERITY_ERROR {
+			t.Errorf("unexpected error: %v", item.Err)
+		}
+	}
+	if t.Failed() {
+		t.FailNow()
+	}
+}
+
+// renderPage builds a site made of files and returns the output of page with its whitespace
+// collapsed, along with the diagnostics of the build.
+func renderPage(t *testing.T, files map[string]string, page string) (string, *Diagnostics) {
+	t.Helper()
+	s, result := buildSite(t, writeSite(t, files), 1)
+	data, err := os.ReadFile(s.PageOutputPath(page))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return strings.Join(strings.Fields(string(data)), " "), result.Diagnostics
+}
+
+// requireError fails the test unless the build reported an error containing message.
+func requireError(t *testing.T, d *Diagnostics, message string) {
+	t.Helper()
+	for _, item := range d.Items() {
+		if item.Severity == SEVERITY_ERROR && strings.Contains(stripANSI(item.Err.Error()), message) {
+			return
+		}
+	}
+	var got []string
+	for _, item := range d.Items() {
+		got = append(got, stripANSI(item.Err.Error()))
+	}
+	t.Fatalf("no error contains %q, got:\n%s", message, strings.Join(got, "\n"))
+}
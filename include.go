@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// defaultMaxIncludeDepth is used when config.yml does not set maxIncludeDepth.
+const defaultMaxIncludeDepth = 64
+
+// includeFrame is one step of the include chain of a page render: a fragment, and the position of
+// the reference or setTemplate call it was included from.
+type includeFrame struct {
+	Fragment *Fragment
+	From     *Fragment
+	Line     int
+	Column   int
+}
+
+// enterInclude adds f, included by from at line and column, to the include chain. It returns an
+// error instead if f is already part of the chain or the chain would grow past maxIncludeDepth.
+// Every successful call must be matched by a call to leaveInclude.
+func (r *RenderContext) enterInclude(f *Fragment, from *Fragment, line, column int) error {
+	frame := includeFrame{Fragment: f, From: from, Line: line, Column: column}
+
+	for _, fr := range r.includes {
+		if sameSource(fr.Fragment, f) {
+			return &EvaluationError{
+				Line:     line,
+				Column:   column,
+				Message:  "Include cycle detected:\n" + formatIncludeChain(append(r.includes, frame)),
+				Fragment: from,
+				Code:     from.Code,
+			}
+		}
+	}
+
+	max := f.Config.MaxIncludeDepth
+	if max <= 0 {
+		max = defaultMaxIncludeDepth
+	}
+	if len(r.includes) > max {
+		return &EvaluationError{
+			Line:     line,
+			Column:   column,
+			Message:  fmt.Sprintf("Maximum include depth of %d exceeded (set maxIncludeDepth in config.yml to raise it):\n%s", max, formatIncludeChain(append(r.includes, frame))),
+			Fragment: from,
+			Code:     from.Code,
+		}
+	}
+
+	r.includes = append(r.includes, frame)
+	return nil
+}
+
+func (r *RenderContext) leaveInclude() {
+	r.includes = r.includes[:len(r.includes)-1]
+}
+
+func sameSource(a, b *Fragment) bool {
+	if a.Path == "" || b.Path == "" {
+		return a.Name == b.Name && a.Type == b.Type
+	}
+	return a.Path == b.Path
+}
+
+// formatIncludeChain prints an include chain one fragment per line, along with the file and
+// position each fragment was included from.
+func formatIncludeChain(chain []includeFrame) string {
+	var sb strings.Builder
+	for i, fr := range chain {
+		if i == 0 {
+			sb.WriteString(fmt.Sprintf("    %s (%s)", fr.Fragment.Name, fr.Fragment.displayPath()))
+			continue
+		}
+		position := fmt.Sprintf("%s:%d", fr.From.displayPath(), fr.Line)
+		if fr.Column > 0 {
+			position += fmt.Sprintf(":%d", fr.Column)
+		}
+		sb.WriteString(fmt.Sprintf("\n  → %s at %s", fr.Fragment.Name, position))
+	}
+	return sb.String()
+}
+
+// displayPath returns the path of the fragment's file relative to the site root.
+func (f *Fragment) displayPath() string {
+	if f.Path == "" {
+		return f.Name
+	}
+	return f.relativePath(f.Path)
+}
+
+// relativePath returns path relative to the site root when possible.
+func (f *Fragment) relativePath(path string) string {
+	return siteRelativePath(f.Config, path)
+}
+
+func siteRelativePath(cfg *Config, path string) string {
+	if cfg != nil {
+		if rel, err := filepath.Rel(cfg.SiteRoot, path); err == nil {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return filepath.ToSlash(path)
+}
+
+// currentLuaLine returns the line of the Lua code that called the running Go function, or 0 if it
+// is not known.
+func currentLuaLine(L *lua.LState) int {
+	dbg, ok := L.GetStack(1)
+	if !ok {
+		return 0
+	}
+	if _, err := L.GetInfo("l", dbg, lua.LNil); err != nil {
+		return 0
+	}
+	return dbg.CurrentLine
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNestedIncludeOfSameFragmentIsNotACycle(t *testing.T) {
+	cfg := writeSite(t, map[string]string{
+		"fragment/card.frag": "~~~\n<div class=\"card\">${CONTENT}</div>",
+		"page/index.frag":    "~~~\n@{card[[outer @{card[[inner]]}]]}",
+	})
+	s, result := buildSite(t, cfg, 1)
+	requireNoErrors(t, result.Diagnostics)
+
+	out := readOutput(t, s, "index")
+	if n := strings.Count(out, `class="card"`); n != 2 {
+		t.Errorf("got %d cards, want 2:\n%s", n, out)
+	}
+	if !strings.Contains(out, "outer") || !strings.Contains(out, "inner") {
+		t.Errorf("missing content:\n%s", out)
+	}
+}
+
+func TestIncludeCycleIsReported(t *testing.T) {
+	cfg := writeSite(t, map[string]string{
+		"fragment/a.frag": "~~~\n@{b}",
+		"fragment/b.frag": "~~~\n@{a}",
+		"page/index.frag": "~~~\n@{a}",
+	})
+	_, result := buildSite(t, cfg, 1)
+	if !result.Diagnostics.HasErrors() {
+		t.Fatal("expected an include cycle error")
+	}
+	found := false
+	for _, item := range result.Diagnostics.Items() {
+		if strings.Contains(item.Err.Error(), "Include cycle detected") {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("no error mentions the include cycle")
+	}
+}
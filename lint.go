@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/charmbracelet/log"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Rules of the warnings about likely mistakes, reported by builds.
+const (
+	RULE_UNUSED_FRAGMENT = "unused-fragment"
+	RULE_UNUSED_BUILDER  = "unused-builder"
+	RULE_SHADOWED_META   = "shadowed-meta"
+	RULE_UNKNOWN_BLOCK   = "unknown-block"
+	RULE_UNKNOWN_PROP    = "unknown-prop"
+)
+
+// LintWarning is a problem that does not stop a page from rendering but is probably a mistake,
+// like a fragment no page uses. Line is 0 when the warning is about a whole file.
+type LintWarning struct {
+	Rule     string
+	Path     string // The .frag file the warning is about, relative to the site root
+	Line     int
+	Column   int
+	Message  string
+	Fragment *Fragment // The fragment the warning was raised in, if any
+	Code     string
+}
+
+func (w *LintWarning) Error() string {
+	if w.Line == 0 || w.Code == "" {
+		if w.Line > 0 {
+			return fmt.Sprintf("%s:%d: %s", w.Path, w.Line, w.Message)
+		}
+		return fmt.Sprintf("%s: %s", w.Path, w.Message)
+	}
+	return formatError("Warning in "+w.Path, w.Line, w.Column, w.Message, w.Code, w.Fragment)
+}
+
+// builderDefinition is a builder function registered with this:addBuilders. Builders are told apart
+// by where their function is defined, so a builder passed on to another fragment with
+// fragments:getBuilders is the same builder.
+type builderDefinition struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path"`
+	Line int    `json:"line"`
+}
+
+func (d builderDefinition) key() builderDefinition {
+	return builderDefinition{Path: d.Path, Line: d.Line}
+}
+
+// usageTracker records which builders were registered and which of them were called while a page
+// was rendered. The manifest keeps what every page recorded, so that builds that only render some
+// of the pages still know about the others.
+type usageTracker struct {
+	defined map[*lua.FunctionProto]builderDefinition
+	called  map[*lua.FunctionProto]bool
+}
+
+func newUsageTracker() *usageTracker {
+	return &usageTracker{
+		defined: make(map[*lua.FunctionProto]builderDefinition),
+		called:  make(map[*lua.FunctionProto]bool),
+	}
+}
+
+func (u *usageTracker) defineBuilder(name string, fn *lua.LFunction) {
+	if fn == nil || fn.Proto == nil {
+		return
+	}
+	if _, ok := u.defined[fn.Proto]; !ok {
+		u.defined[fn.Proto] = builderDefinition{Name: name, Path: fn.Proto.SourceName, Line: fn.Proto.LineDefined}
+	}
+}
+
+func (u *usageTracker) callBuilder(fn *lua.LFunction) {
+	if fn == nil || fn.Proto == nil {
+		return
+	}
+	u.called[fn.Proto] = true
+}
+
+// definedBuilders returns the builders registered while the page was rendered, ordered by file and line.
+func (u *usageTracker) definedBuilders() []builderDefinition {
+	defs := make([]builderDefinition, 0, len(u.defined))
+	for _, def := range u.defined {
+		defs = append(defs, def)
+	}
+	sortBuilders(defs)
+	return defs
+}
+
+// calledBuilders returns the builders called while the page was rendered, ordered by file and line.
+func (u *usageTracker) calledBuilders() []builderDefinition {
+	calls := make([]builderDefinition, 0, len(u.called))
+	for proto := range u.called {
+		calls = append(calls, builderDefinition{Path: proto.SourceName, Line: proto.LineDefined})
+	}
+	sortBuilders(calls)
+	return calls
+}
+
+// renderRegistryKey is the key of the Lua registry under which a page's VM keeps its render.
+const renderRegistryKey = "fragments.render"
+
+func setRenderOf(L *lua.LState, r *RenderContext) {
+	ud := L.NewUserData()
+	ud.Value = r
+	L.G.Registry.RawSetString(renderRegistryKey, ud)
+}
+
+// renderOf returns the render of the page whose VM L is, or nil if L is not a page's VM.
+func renderOf(L *lua.LState) *RenderContext {
+	if ud, ok := L.G.Registry.RawGetString(renderRegistryKey).(*lua.LUserData); ok {
+		if r, ok := ud.Value.(*RenderContext); ok {
+			return r
+		}
+	}
+	return nil
+}
+
+// builderTable returns builders as the Lua table this:builders() and fragments:getBuilders return.
+// Its functions record that the builder was called in the page calling them, so that builders only
+// called from Lua count as used like the ones referenced with *{...}.
+func builderTable(L *lua.LState, builders *CoreTable) *lua.LTable {
+	t := L.NewTable()
+	for name, v := range builders.v {
+		fn, ok := v.(*CoreFunction)
+		if !ok || fn.v.Proto == nil {
+			t.RawSetString(name, v.luaType(L))
+			continue
+		}
+		builder := fn.v
+		t.RawSetString(name, L.NewFunction(func(L *lua.LState) int {
+			if r := renderOf(L); r != nil {
+				r.CallBuilder(builder)
+			}
+			top := L.GetTop()
+			L.Push(builder)
+			for i := 1; i <= top; i++ {
+				L.Push(L.Get(i))
+			}
+			L.Call(top, lua.MultRet)
+			return L.GetTop() - top
+		}))
+	}
+	return t
+}
+
+// unusedBuilders returns the builders that some page registered but no page called, ordered by file
+// and line.
+func unusedBuilders(pages map[string]*ManifestPage) []builderDefinition {
+	defined := make(map[builderDefinition]builderDefinition)
+	called := make(map[builderDefinition]bool)
+	for _, page := range pages {
+		for _, def := range page.DefinedBuilders {
+			defined[def.key()] = def
+		}
+		for _, call := range page.CalledBuilders {
+			called[call.key()] = true
+		}
+	}
+	var unused []builderDefinition
+	for key, def := range defined {
+		if !called[key] {
+			unused = append(unused, def)
+		}
+	}
+	sortBuilders(unused)
+	return unused
+}
+
+func sortBuilders(defs []builderDefinition) {
+	sort.Slice(defs, func(i, j int) bool {
+		if defs[i].Path != defs[j].Path {
+			return defs[i].Path < defs[j].Path
+		}
+		if defs[i].Line != defs[j].Line {
+			return defs[i].Line < defs[j].Line
+		}
+		return defs[i].Name < defs[j].Name
+	})
+}
+
+// lint reports fragments that no page reaches and builders that no page calls. Both are worked out
+// from the manifest, which also holds what pages this build did not render read and called.
+// Warnings about a single page, like shadowed metadata, are reported while the page is rendered.
+func (s *Site) lint(m *Manifest) {
+	reached := make(map[string]bool)
+	for _, page := range m.Pages {
+		for _, dep := range page.Dependencies {
+			if dep.Kind == DEP_FRAGMENT || dep.Kind == DEP_TEMPLATE {
+				reached[dep.Name] = true
+			}
+		}
+	}
+
+	names := s.Cache.fragmentNames(FRAGMENT)
+	sort.Strings(names)
+	for _, name := range names {
+		if reached[name] {
+			continue
+		}
+		s.warn(&LintWarning{
+			Rule:    RULE_UNUSED_FRAGMENT,
+			Path:    siteRelativePath(s.Config, filepath.Join(s.FragmentDir(), filepath.FromSlash(name)+".frag")),
+			Message: fmt.Sprintf("Fragment `%s` is not used by any page", name),
+		})
+	}
+
+	for _, def := range unusedBuilders(m.Pages) {
+		s.warn(&LintWarning{
+			Rule:    RULE_UNUSED_BUILDER,
+			Path:    siteRelativePath(s.Config, def.Path),
+			Line:    def.Line,
+			Message: fmt.Sprintf("Builder `%s` is never called", def.Name),
+		})
+	}
+}
+
+func (s *Site) warn(w *LintWarning) {
+	log.Warn(w.Error())
+	s.Diagnostics.Report("", SEVERITY_WARNING, w)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// lintWarnings returns the messages of the warnings of a rule.
+func lintWarnings(d *Diagnostics, rule string) []string {
+	var messages []string
+	for _, item := range d.Items() {
+		if w, ok := item.Err.(*LintWarning); ok && w.Rule == rule {
+			messages = append(messages, w.Message)
+		}
+	}
+	return messages
+}
+
+func TestUnusedBuildersOnIncrementalBuilds(t *testing.T) {
+	files := map[string]string{
+		"fragment/nav.frag": "this:addBuilders {\n" +
+			"    used = function(content) return content end,\n" +
+			"    unused = function(content) return content end,\n" +
+			"}\n~~~\n<nav>*{used[[home]]}</nav>",
+		"page/a.frag": "~~~\n@{nav}<p>a</p>",
+		"page/b.frag": "~~~\n@{nav}<p>b</p>",
+	}
+	cfg := writeSite(t, files)
+
+	_, result := buildSite(t, cfg, 1)
+	requireNoErrors(t, result.Diagnostics)
+	want := "Builder `unused` is never called"
+	if got := lintWarnings(result.Diagnostics, RULE_UNUSED_BUILDER); len(got) != 1 || got[0] != want {
+		t.Fatalf("full build: got %q, want [%q]", got, want)
+	}
+
+	// Only a is rendered again. b reused the evaluation of nav made for a, and still calls used.
+	if err := os.WriteFile(filepath.Join(filepath.Dir(cfg), "page", "a.frag"), []byte("~~~\n<p>a</p>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, result = buildSite(t, cfg, 1)
+	requireNoErrors(t, result.Diagnostics)
+	if len(result.Pages) != 1 || result.Pages[0] != "a" {
+		t.Fatalf("expected only a to be rendered, got %v", result.Pages)
+	}
+	if got := lintWarnings(result.Diagnostics, RULE_UNUSED_BUILDER); len(got) != 1 || got[0] != want {
+		t.Errorf("incremental build: got %q, want [%q]", got, want)
+	}
+}
+
+func TestBuildersCalledFromLuaAreUsed(t *testing.T) {
+	files := map[string]string{
+		"fragment/tools.frag": "this:addBuilders {\n" +
+			"    shout = function(content) return content .. \"!\" end,\n" +
+			"    whisper = function(content) return content .. \"...\" end,\n" +
+			"    unused = function(content) return content end,\n" +
+			"}\n" +
+			"this:setLocalMeta { text = this:builders().shout(\"hi\") }\n~~~\n<p>${text}</p>",
+		"page/index.frag": "local tools = fragments:getBuilders(\"fragment\", \"tools\")\n" +
+			"this:setLocalMeta { quiet = tools[\"whisper\"](\"psst\") }\n~~~\n@{tools}<p>${quiet}</p>",
+	}
+	out, d := renderPage(t, files, "index")
+	requireNoErrors(t, d)
+	if want := "<p> hi! </p> <p> psst... </p>"; out != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+	want := "Builder `unused` is never called"
+	if got := lintWarnings(d, RULE_UNUSED_BUILDER); len(got) != 1 || got[0] != want {
+		t.Errorf("got %q, want [%q]", got, want)
+	}
+}
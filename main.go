@@ -8,9 +8,9 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/charmbracelet/log"
-	"github.com/yosssi/gohtml"
 )
 
 func RecursivelyFindPages(op string, cache *FragmentCache) map[string]*Fragment {
@@ -35,7 +35,11 @@ func RecursivelyFindPages(op string, cache *FragmentCache) map[string]*Fragment
 		rel = filepath.ToSlash(rel)
 		fragmentName := strings.TrimSuffix(rel, ".frag")
 
-		f := GetFragmentFromName(fragmentName, PAGE, cache)
+		f, ferr := GetFragmentFromName(fragmentName, PAGE, cache)
+		if ferr != nil {
+			log.Error("Error reading page", "name", fragmentName, "error", ferr)
+			return nil
+		}
 		pageMap[fragmentName] = f
 		return nil
 	})
@@ -86,58 +90,108 @@ func copyDir(src, dst string) error {
 	})
 }
 
-func build(siteConfigPath string) {
-	cfg, err := GetConfiguration(siteConfigPath)
+// build builds the site once and exits with a non-zero status if any page failed. With a
+// diagnostics format other than "text", every diagnostic is also written to stdout.
+func build(siteConfigPath string, jobs int, force bool, failFast bool, diagnosticsFormat string) {
+	site, err := LoadSite(siteConfigPath)
 	if err != nil {
 		log.Error("Failed to read configuration", "path", siteConfigPath, "error", err)
-		return
+		os.Exit(1)
 	}
 
-	fcache := NewFragmentCache(cfg)
+	site.Jobs = jobs
+	site.Force = force
+	site.FailFast = failFast
+	result := site.Build()
+	if err := WriteDiagnostics(os.Stdout, diagnosticsFormat, result.Diagnostics, site.Config.SiteRoot); err != nil {
+		log.Error("Failed to write diagnostics", "error", err)
+		os.Exit(1)
+	}
+	if result.Diagnostics.HasErrors() {
+		os.Exit(1)
+	}
+}
 
-	pageDir := filepath.Join(cfg.SiteRoot, cfg.PagePath)
-	pageMap := RecursivelyFindPages(pageDir, fcache)
+// check validates the site without building it and exits with a non-zero status if it has errors.
+func check(siteConfigPath string, jobs int, diagnosticsFormat string) {
+	site, err := LoadSite(siteConfigPath)
+	if err != nil {
+		log.Error("Failed to read configuration", "path", siteConfigPath, "error", err)
+		os.Exit(1)
+	}
 
-	for _, v := range pageMap {
-		_ = v.Evaluate()
+	site.Jobs = jobs
+	diagnostics := site.Check()
+	if err := WriteDiagnostics(os.Stdout, diagnosticsFormat, diagnostics, site.Config.SiteRoot); err != nil {
+		log.Error("Failed to write diagnostics", "error", err)
+		os.Exit(1)
+	}
+	if diagnostics.HasErrors() {
+		os.Exit(1)
 	}
+}
 
-	buildDir := filepath.Join(cfg.SiteRoot, cfg.BuildPath)
-	if err := os.MkdirAll(buildDir, os.ModePerm); err != nil {
-		log.Error("Failed to create build dir", "dir", buildDir, "error", err)
+// graph writes the dependency graph of the site to stdout and exits with a non-zero status if any
+// page failed, since the graph then misses what the failing pages did not reach.
+func graph(siteConfigPath string, jobs int, format string) {
+	site, err := LoadSite(siteConfigPath)
+	if err != nil {
+		log.Error("Failed to read configuration", "path", siteConfigPath, "error", err)
+		os.Exit(1)
 	}
 
-	includeDir := filepath.Join(cfg.SiteRoot, cfg.IncludePath)
-	if info, err := os.Stat(includeDir); err == nil && info.IsDir() {
-		if err := copyDir(includeDir, buildDir); err != nil {
-			log.Error("Failed to copy include directory", "error", err)
-		}
-	} else {
-		log.Debug("Include directory not found or not a directory", "path", includeDir)
+	site.Jobs = jobs
+	g, diagnostics := site.Graph()
+	if err := WriteGraph(os.Stdout, format, g); err != nil {
+		log.Error("Failed to write graph", "error", err)
+		os.Exit(1)
+	}
+	if diagnostics.HasErrors() {
+		log.Error("The graph is incomplete because some pages failed", "errors", diagnostics.Count(SEVERITY_ERROR))
+		os.Exit(1)
 	}
+}
 
-	for k, v := range pageMap {
-		log.Info("Building page", "name", k)
-		res := v.Evaluate()
-		res = gohtml.Format(res)
+// explain prints how a metadata key of a page was set and read while the page was evaluated.
+func explain(siteConfigPath string, page string, key string) {
+	site, err := LoadSite(siteConfigPath)
+	if err != nil {
+		log.Error("Failed to read configuration", "path", siteConfigPath, "error", err)
+		os.Exit(1)
+	}
 
-		dest := filepath.Join(buildDir, k+".html")
-		if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
-			log.Error("Error creating directories", "dir", filepath.Dir(dest), "error", err)
-		}
-		file, err := os.Create(dest)
-		if err != nil {
-			log.Error("Error creating file", "file", dest, "error", err)
-			continue
-		}
+	trace, err := site.Explain(page, key)
+	if err != nil {
+		log.Error(err.Error())
+		os.Exit(1)
+	}
+	if err := trace.WriteText(os.Stdout); err != nil {
+		log.Error("Failed to write explanation", "error", err)
+		os.Exit(1)
+	}
+}
 
-		if _, err := file.Write([]byte(res)); err != nil {
-			log.Error("Error writing to file", "file", dest, "error", err)
-		}
+// requireDiagnosticsFormat exits if format is not one of the formats WriteDiagnostics supports.
+func requireDiagnosticsFormat(format string) {
+	switch format {
+	case "text", "json", "sarif":
+	default:
+		log.Error("Unknown diagnostics format", "format", format, "expected", "text, json or sarif")
+		os.Exit(1)
+	}
+}
 
-		file.Close()
-		log.Info("Page built", "name", k, "out", dest)
+func watch(siteConfigPath string, interval time.Duration, jobs int) {
+	site, err := LoadSite(siteConfigPath)
+	if err != nil {
+		log.Error("Failed to read configuration", "path", siteConfigPath, "error", err)
+		os.Exit(1)
 	}
+
+	site.Jobs = jobs
+	site.Build()
+	log.Info("Watching for changes", "root", site.Config.SiteRoot, "interval", interval)
+	site.Watch(interval, nil)
 }
 
 func printUsage() {
@@ -145,16 +199,47 @@ func printUsage() {
 
 Usage:
   fragments init [dir]
-  fragments build [-c|--config path/to/config.yml]
+  fragments build [-c|--config path/to/config.yml] [-j|--jobs N] [--force] [--fail-fast|--keep-going]
+                  [--diagnostics-format text|json|sarif]
+  fragments check [-c|--config path/to/config.yml] [-j|--jobs N] [--diagnostics-format text|json|sarif]
+  fragments graph [-c|--config path/to/config.yml] [-j|--jobs N] [--format dot|mermaid|json]
+  fragments explain [-c|--config path/to/config.yml] <page> <key>
+  fragments watch [-c|--config path/to/config.yml] [-j|--jobs N] [--interval 500ms]
+  fragments serve [-c|--config path/to/config.yml] [-j|--jobs N] [--addr :8080] [--interval 500ms] [--on-demand]
   fragments help
 
 Commands:
   init    Create a new project skeleton.
-  build   Build the site into the configured build directory.
+  build   Build the site into the configured build directory, skipping pages that have not
+          changed since the last build. With --force, render every page. Exits with status 1
+          if any page fails; --fail-fast stops at the first failing page. With
+          --diagnostics-format json or sarif, errors and warnings are also written to stdout
+          for editors and CI.
+  check   Parse every page and fragment, check that every fragment, template, builder and
+          meta key they refer to can be found, and run the Lua section of every page, without
+          writing anything. The Lua runs without io, os.execute or the modules that reach the
+          filesystem, network or other processes. Any word of a Lua section counts as a key
+          that may be set, so keys built at run time are not reported. Exits with status 1 if
+          there are errors.
+  graph   Evaluate every page and print which page, fragment and template reads which,
+          including fragments:getPage, getPagesUnder and getBuilders calls, as Graphviz DOT,
+          a Mermaid flowchart or JSON.
+  explain Evaluate a page and show where the value of ${key} came from: every
+          setLocalMeta and setSharedMeta call that set the key, how shared metadata was
+          passed on to fragments and templates, and what each ${key} reference read.
+  watch   Build the site, then rebuild the affected pages whenever a source file changes.
+  serve   Watch the site and serve the build directory with live reload. With --on-demand,
+          render each page when it is requested instead of building the site.
 
 Examples:
   fragments init mysite
-  fragments build -c mysite/config.yml`)
+  fragments build -c mysite/config.yml
+  fragments build -c mysite/config.yml -j 8
+  fragments check -c mysite/config.yml
+  fragments graph -c mysite/config.yml | dot -Tsvg > graph.svg
+  fragments explain -c mysite/config.yml posts/example title
+  fragments watch -c mysite/config.yml
+  fragments serve -c mysite/config.yml --addr :3000`)
 }
 
 func main() {
@@ -189,14 +274,150 @@ func main() {
 		fs := flag.NewFlagSet("build", flag.ExitOnError)
 		cfgPathLong := fs.String("config", "config.yml", "Path to site config (YAML)")
 		cfgPathShort := fs.String("c", "", "Path to site config (YAML) [shorthand]")
+		jobsLong := fs.Int("jobs", 0, "Number of pages to build in parallel (default: number of CPUs)")
+		jobsShort := fs.Int("j", 0, "Number of pages to build in parallel [shorthand]")
+		force := fs.Bool("force", false, "Ignore the build manifest and render every page")
+		failFast := fs.Bool("fail-fast", false, "Stop the build at the first page that fails")
+		keepGoing := fs.Bool("keep-going", false, "Render every page even if some fail (default)")
+		diagnosticsFormat := fs.String("diagnostics-format", "text", "Also write diagnostics to stdout: text, json or sarif")
 		_ = fs.Parse(os.Args[2:])
 
+		requireDiagnosticsFormat(*diagnosticsFormat)
+
 		cfgPath := *cfgPathLong
 		if *cfgPathShort != "" {
 			cfgPath = *cfgPathShort
 		}
 
-		build(cfgPath)
+		jobs := *jobsLong
+		if *jobsShort != 0 {
+			jobs = *jobsShort
+		}
+
+		build(cfgPath, jobs, *force, *failFast && !*keepGoing, *diagnosticsFormat)
+		return
+
+	case "check":
+		fs := flag.NewFlagSet("check", flag.ExitOnError)
+		cfgPathLong := fs.String("config", "config.yml", "Path to site config (YAML)")
+		cfgPathShort := fs.String("c", "", "Path to site config (YAML) [shorthand]")
+		jobsLong := fs.Int("jobs", 0, "Number of pages to check in parallel (default: number of CPUs)")
+		jobsShort := fs.Int("j", 0, "Number of pages to check in parallel [shorthand]")
+		diagnosticsFormat := fs.String("diagnostics-format", "text", "Also write diagnostics to stdout: text, json or sarif")
+		_ = fs.Parse(os.Args[2:])
+
+		requireDiagnosticsFormat(*diagnosticsFormat)
+
+		cfgPath := *cfgPathLong
+		if *cfgPathShort != "" {
+			cfgPath = *cfgPathShort
+		}
+
+		jobs := *jobsLong
+		if *jobsShort != 0 {
+			jobs = *jobsShort
+		}
+
+		check(cfgPath, jobs, *diagnosticsFormat)
+		return
+
+	case "graph":
+		fs := flag.NewFlagSet("graph", flag.ExitOnError)
+		cfgPathLong := fs.String("config", "config.yml", "Path to site config (YAML)")
+		cfgPathShort := fs.String("c", "", "Path to site config (YAML) [shorthand]")
+		jobsLong := fs.Int("jobs", 0, "Number of pages to evaluate in parallel (default: number of CPUs)")
+		jobsShort := fs.Int("j", 0, "Number of pages to evaluate in parallel [shorthand]")
+		format := fs.String("format", "dot", "Output format: dot, mermaid or json")
+		_ = fs.Parse(os.Args[2:])
+
+		switch *format {
+		case "dot", "mermaid", "json":
+		default:
+			log.Error("Unknown graph format", "format", *format, "expected", "dot, mermaid or json")
+			os.Exit(1)
+		}
+
+		cfgPath := *cfgPathLong
+		if *cfgPathShort != "" {
+			cfgPath = *cfgPathShort
+		}
+
+		jobs := *jobsLong
+		if *jobsShort != 0 {
+			jobs = *jobsShort
+		}
+
+		graph(cfgPath, jobs, *format)
+		return
+
+	case "explain":
+		fs := flag.NewFlagSet("explain", flag.ExitOnError)
+		cfgPathLong := fs.String("config", "config.yml", "Path to site config (YAML)")
+		cfgPathShort := fs.String("c", "", "Path to site config (YAML) [shorthand]")
+		_ = fs.Parse(os.Args[2:])
+
+		args := fs.Args()
+		if len(args) != 2 {
+			fmt.Println("Usage: fragments explain [-c|--config path/to/config.yml] <page> <key>")
+			os.Exit(1)
+		}
+
+		cfgPath := *cfgPathLong
+		if *cfgPathShort != "" {
+			cfgPath = *cfgPathShort
+		}
+
+		explain(cfgPath, args[0], args[1])
+		return
+
+	case "watch":
+		fs := flag.NewFlagSet("watch", flag.ExitOnError)
+		cfgPathLong := fs.String("config", "config.yml", "Path to site config (YAML)")
+		cfgPathShort := fs.String("c", "", "Path to site config (YAML) [shorthand]")
+		jobsLong := fs.Int("jobs", 0, "Number of pages to build in parallel (default: number of CPUs)")
+		jobsShort := fs.Int("j", 0, "Number of pages to build in parallel [shorthand]")
+		interval := fs.Duration("interval", 500*time.Millisecond, "How often to poll for changes")
+		_ = fs.Parse(os.Args[2:])
+
+		cfgPath := *cfgPathLong
+		if *cfgPathShort != "" {
+			cfgPath = *cfgPathShort
+		}
+
+		jobs := *jobsLong
+		if *jobsShort != 0 {
+			jobs = *jobsShort
+		}
+
+		watch(cfgPath, *interval, jobs)
+		return
+
+	case "serve":
+		fs := flag.NewFlagSet("serve", flag.ExitOnError)
+		cfgPathLong := fs.String("config", "config.yml", "Path to site config (YAML)")
+		cfgPathShort := fs.String("c", "", "Path to site config (YAML) [shorthand]")
+		jobsLong := fs.Int("jobs", 0, "Number of pages to build in parallel (default: number of CPUs)")
+		jobsShort := fs.Int("j", 0, "Number of pages to build in parallel [shorthand]")
+		addr := fs.String("addr", ":8080", "Address to listen on")
+		interval := fs.Duration("interval", 500*time.Millisecond, "How often to poll for changes")
+		onDemand := fs.Bool("on-demand", false, "Render pages per request without writing the build directory")
+		_ = fs.Parse(os.Args[2:])
+
+		cfgPath := *cfgPathLong
+		if *cfgPathShort != "" {
+			cfgPath = *cfgPathShort
+		}
+
+		jobs := *jobsLong
+		if *jobsShort != 0 {
+			jobs = *jobsShort
+		}
+
+		if *onDemand {
+			serveOnDemand(cfgPath, *addr, *interval)
+			return
+		}
+		serve(cfgPath, *addr, *interval, jobs)
 		return
 
 	default:
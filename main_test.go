@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runFragments runs the fragments command with the given arguments and returns its exit status.
+func runFragments(t *testing.T, args ...string) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "FRAGMENTS_TEST_ARGS="+strings.Join(args, "\n"))
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return 0
+}
+
+func TestBuildExitStatus(t *testing.T) {
+	files := map[string]string{"page/a.frag": "~~~\n<p>a</p>"}
+	for _, name := range []string{"b", "c", "d", "e", "f", "g", "h"} {
+		files["page/"+name+".frag"] = "~~~\n<p>" + name + "</p>"
+	}
+	cfg := writeSite(t, files)
+	if status := runFragments(t, "build", "-c", cfg); status != 0 {
+		t.Fatalf("got status %d for a site without errors, want 0", status)
+	}
+
+	editSite(t, cfg, map[string]string{"page/a.frag": "error(\"boom\")\n~~~\n<p>a</p>"})
+	built := func() int {
+		n := 0
+		for _, name := range []string{"b", "c", "d", "e", "f", "g", "h"} {
+			if _, err := os.Stat(filepath.Join(filepath.Dir(cfg), "build", name+".html")); err == nil {
+				n++
+			}
+		}
+		return n
+	}
+
+	if err := os.RemoveAll(filepath.Join(filepath.Dir(cfg), "build")); err != nil {
+		t.Fatal(err)
+	}
+	if status := runFragments(t, "build", "-c", cfg, "-j", "1", "--force", "--fail-fast"); status != 1 {
+		t.Errorf("got status %d with --fail-fast, want 1", status)
+	}
+	if n := built(); n == 7 {
+		t.Error("--fail-fast rendered every page after the one that failed")
+	}
+
+	if status := runFragments(t, "build", "-c", cfg, "-j", "1", "--force"); status != 1 {
+		t.Errorf("got status %d, want 1", status)
+	}
+	if n := built(); n != 7 {
+		t.Errorf("expected every other page to be rendered, got %d of 7", n)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// manifestVersion is bumped whenever the manifest format changes, which forces a full build.
+const manifestVersion = 2
+
+// Manifest records what the previous build read and wrote, so that the next build only renders the
+// pages whose sources or dependencies changed. It is stored as JSON in the cache directory.
+type Manifest struct {
+	Version   int                      `json:"version"`
+	Config    string                   `json:"config"`    // Hash of the configuration file
+	Fragments map[string]string        `json:"fragments"` // Hashes of fragment and template files, keyed by name
+	Assets    map[string]string        `json:"assets"`    // Hashes of include files, keyed by path relative to the include directory
+	Pages     map[string]*ManifestPage `json:"pages"`
+}
+
+type ManifestPage struct {
+	Source       string       `json:"source"`           // Hash of the page's .frag file
+	Output       string       `json:"output"`           // Hash of the HTML written for the page
+	Failed       bool         `json:"failed,omitempty"` // The page had errors and is rendered again on the next build
+	Dependencies []Dependency `json:"dependencies"`
+
+	// The builders registered and called while the page was rendered, for lint
+	DefinedBuilders []builderDefinition `json:"definedBuilders,omitempty"`
+	CalledBuilders  []builderDefinition `json:"calledBuilders,omitempty"`
+}
+
+func LoadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Manifest) Save(path string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func hashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashTree hashes every file under dir, keyed by its slash-separated path relative to dir. If ext is
+// not empty only files with that extension are hashed, and the extension is dropped from the key.
+func hashTree(dir string, ext string) map[string]string {
+	hashes := make(map[string]string)
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if ext != "" && filepath.Ext(path) != ext {
+			return nil
+		}
+		rel, ok := relativeTo(dir, path)
+		if !ok {
+			return nil
+		}
+		hash, err := hashFile(path)
+		if err != nil {
+			return nil
+		}
+		hashes[strings.TrimSuffix(rel, ext)] = hash
+		return nil
+	})
+	return hashes
+}
+
+func (s *Site) CacheDir() string {
+	return filepath.Join(s.Config.SiteRoot, s.Config.CachePath)
+}
+
+func (s *Site) ManifestPath() string {
+	return filepath.Join(s.CacheDir(), "manifest.json")
+}
+
+// scanSources hashes the configuration and every fragment, page and include file. The returned
+// manifest has no dependencies or outputs recorded yet.
+func (s *Site) scanSources() *Manifest {
+	m := &Manifest{
+		Version:   manifestVersion,
+		Fragments: hashTree(s.FragmentDir(), ".frag"),
+		Assets:    hashTree(s.IncludeDir(), ""),
+		Pages:     make(map[string]*ManifestPage),
+	}
+	m.Config, _ = hashFile(s.ConfigPath)
+	for name, hash := range hashTree(s.PageDir(), ".frag") {
+		m.Pages[name] = &ManifestPage{Source: hash}
+	}
+	return m
+}
+
+// previousManifest loads the manifest written by the last build. It returns nil if the site has to
+// be built from scratch: the manifest is missing, unreadable or outdated, or the configuration changed.
+func (s *Site) previousManifest(current *Manifest) *Manifest {
+	prev, err := LoadManifest(s.ManifestPath())
+	if err != nil {
+		return nil
+	}
+	if prev.Version != manifestVersion || prev.Config != current.Config {
+		return nil
+	}
+	return prev
+}
+
+// stalePages works out which pages need to be rendered again, given the manifest of the previous
+// build and the current sources.
+func (s *Site) stalePages(prev, current *Manifest) []string {
+	var changes []Dependency
+	for name, hash := range current.Fragments {
+		if prev.Fragments[name] != hash {
+			changes = append(changes, Dependency{DEP_FRAGMENT, name})
+		}
+	}
+	for name := range prev.Fragments {
+		if _, ok := current.Fragments[name]; !ok {
+			changes = append(changes, Dependency{DEP_FRAGMENT, name})
+		}
+	}
+
+	pageDeps := make(map[string]*DependencySet, len(current.Pages))
+	for name, page := range current.Pages {
+		old, ok := prev.Pages[name]
+		if !ok || old.Source != page.Source {
+			changes = append(changes, Dependency{DEP_PAGE, name})
+		}
+		deps := NewDependencySet()
+		if ok {
+			for _, dep := range old.Dependencies {
+				deps.Add(dep)
+			}
+		}
+		pageDeps[name] = deps
+	}
+	for name := range prev.Pages {
+		if _, ok := current.Pages[name]; !ok {
+			changes = append(changes, Dependency{DEP_PAGE, name})
+		}
+	}
+
+	stale := make(map[string]bool)
+	for _, name := range AffectedPages(pageDeps, changes) {
+		if _, ok := current.Pages[name]; ok {
+			stale[name] = true
+		}
+	}
+
+	// Pages that failed last time are rendered again so their errors are reported, and pages whose
+	// output went missing or was edited by hand are rewritten
+	for name := range current.Pages {
+		old, ok := prev.Pages[name]
+		if !ok || old.Failed {
+			stale[name] = true
+			continue
+		}
+		if hash, err := hashFile(s.PageOutputPath(name)); err != nil || hash != old.Output {
+			stale[name] = true
+		}
+	}
+
+	return sortedKeys(stale)
+}
+
+// carryOver copies what prev recorded about each page's output and dependencies, for pages that
+// are not rendered again.
+func (m *Manifest) carryOver(prev *Manifest) {
+	for name, page := range m.Pages {
+		if old, ok := prev.Pages[name]; ok {
+			page.Output = old.Output
+			page.Failed = old.Failed
+			page.Dependencies = old.Dependencies
+			page.DefinedBuilders = old.DefinedBuilders
+			page.CalledBuilders = old.CalledBuilders
+		}
+	}
+}
+
+// recordPages stores the dependencies and output hashes of freshly rendered pages in the manifest.
+func (m *Manifest) recordPages(pages map[string]*Fragment, outputs map[string]string, errs map[string][]error) {
+	for name, f := range pages {
+		page, ok := m.Pages[name]
+		if !ok {
+			page = &ManifestPage{}
+			m.Pages[name] = page
+		}
+		output, rendered := outputs[name]
+		page.Output = output
+		// Pages skipped by a build that stopped early count as failed, so the next build renders them
+		page.Failed = len(errs[name]) > 0 || !rendered
+		page.Dependencies = f.Render.Dependencies.List()
+		page.DefinedBuilders = f.Render.usage.definedBuilders()
+		page.CalledBuilders = f.Render.usage.calledBuilders()
+	}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// incrementalFixture is a site with a page that includes a fragment, a page that lists posts and
+// a page that depends on nothing, along with an include file.
+func incrementalFixture() map[string]string {
+	return map[string]string{
+		"fragment/nav.frag": "~~~\n<nav>nav</nav>",
+		"fragment/list.frag": `this:addBuilders {
+    posts = function()
+        local pages, ids = fragments:getPagesUnder("posts"), {}
+        for id in pairs(pages) do table.insert(ids, id) end
+        table.sort(ids)
+        local out = ""
+        for _, id in ipairs(ids) do
+            out = out .. "<li>" .. tostring(pages[id]:getSharedMeta("title")) .. "</li>"
+        end
+        return out
+    end
+}
+~~~
+<ul>*{posts}</ul>`,
+		"page/index.frag":   "~~~\n@{list}",
+		"page/about.frag":   "~~~\n@{nav}<p>about</p>",
+		"page/contact.frag": "~~~\n<p>contact</p>",
+		"page/posts/a.frag": "this:setSharedMeta { title = \"Post A\" }\n~~~\n<h1>${title}</h1>",
+		"include/style.css": "body { color: black; }",
+	}
+}
+
+// editSite writes files, by path relative to the root of the site at configPath.
+func editSite(t *testing.T, configPath string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(filepath.Dir(configPath), filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// removeFromSite deletes a file, by path relative to the root of the site at configPath.
+func removeFromSite(t *testing.T, configPath string, name string) {
+	t.Helper()
+	if err := os.Remove(filepath.Join(filepath.Dir(configPath), filepath.FromSlash(name))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// requirePages fails the test unless the build rendered exactly the given pages.
+func requirePages(t *testing.T, result RebuildResult, want ...string) {
+	t.Helper()
+	if result.Full {
+		t.Fatalf("expected an incremental build, got a full build of %v", result.Pages)
+	}
+	if len(want) == 0 && len(result.Pages) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(result.Pages, want) {
+		t.Fatalf("got %v rendered, want %v", result.Pages, want)
+	}
+}
+
+func TestIncrementalBuildRendersPagesUsingChangedFragment(t *testing.T) {
+	cfg := writeSite(t, incrementalFixture())
+	_, result := buildSite(t, cfg, 1)
+	requireNoErrors(t, result.Diagnostics)
+	if !result.Full {
+		t.Fatal("expected the first build to be a full build")
+	}
+
+	_, result = buildSite(t, cfg, 1)
+	requirePages(t, result)
+
+	editSite(t, cfg, map[string]string{"fragment/nav.frag": "~~~\n<nav>new nav</nav>"})
+	s, result := buildSite(t, cfg, 1)
+	requireNoErrors(t, result.Diagnostics)
+	requirePages(t, result, "about")
+	if out := readOutput(t, s, "about"); !strings.Contains(out, "new nav") {
+		t.Errorf("about was not updated: %s", out)
+	}
+}
+
+func TestIncrementalBuildRendersListingsOfChangedPosts(t *testing.T) {
+	cfg := writeSite(t, incrementalFixture())
+	buildSite(t, cfg, 1)
+
+	editSite(t, cfg, map[string]string{"page/posts/b.frag": "this:setSharedMeta { title = \"Post B\" }\n~~~\n<h1>${title}</h1>"})
+	s, result := buildSite(t, cfg, 1)
+	requireNoErrors(t, result.Diagnostics)
+	requirePages(t, result, "index", "posts/b")
+	if out := readOutput(t, s, "index"); !strings.Contains(out, "Post B") {
+		t.Errorf("index does not list the new post: %s", out)
+	}
+
+	editSite(t, cfg, map[string]string{"page/posts/a.frag": "this:setSharedMeta { title = \"Post A, edited\" }\n~~~\n<h1>${title}</h1>"})
+	s, result = buildSite(t, cfg, 1)
+	requireNoErrors(t, result.Diagnostics)
+	requirePages(t, result, "index", "posts/a")
+	if out := readOutput(t, s, "index"); !strings.Contains(out, "Post A, edited") {
+		t.Errorf("index does not list the edited post: %s", out)
+	}
+}
+
+func TestIncrementalBuildRemovesDeletedPages(t *testing.T) {
+	cfg := writeSite(t, incrementalFixture())
+	buildSite(t, cfg, 1)
+
+	removeFromSite(t, cfg, "page/contact.frag")
+	s, result := buildSite(t, cfg, 1)
+	requireNoErrors(t, result.Diagnostics)
+	requirePages(t, result)
+	if !reflect.DeepEqual(result.Removed, []string{"contact"}) {
+		t.Errorf("got %v removed, want [contact]", result.Removed)
+	}
+	if _, err := os.Stat(s.PageOutputPath("contact")); !os.IsNotExist(err) {
+		t.Errorf("the output of contact was not removed: %v", err)
+	}
+}
+
+func TestIncrementalBuildRendersFailedPagesAgain(t *testing.T) {
+	files := map[string]string{
+		"page/a.frag": "error(\"boom\")\n~~~\n<p>a</p>",
+	}
+	for _, name := range []string{"b", "c", "d", "e"} {
+		files["page/"+name+".frag"] = "~~~\n<p>" + name + "</p>"
+	}
+	cfg := writeSite(t, files)
+
+	s, err := LoadSite(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Jobs = 1
+	s.FailFast = true
+	result := s.Build()
+	requireError(t, result.Diagnostics, "boom")
+
+	// Pages are handed out in name order, so the build stops before it gets to the last pages
+	want := []string{"a"}
+	for _, name := range []string{"b", "c", "d", "e"} {
+		if _, err := os.Stat(s.PageOutputPath(name)); os.IsNotExist(err) {
+			want = append(want, name)
+		}
+	}
+	if len(want) == 1 {
+		t.Fatal("expected --fail-fast to skip pages")
+	}
+
+	_, result = buildSite(t, cfg, 1)
+	requirePages(t, result, want...)
+	requireError(t, result.Diagnostics, "boom")
+
+	// a still fails, so it is rendered every time
+	_, result = buildSite(t, cfg, 1)
+	requirePages(t, result, "a")
+}
+
+func TestIncrementalBuildRewritesEditedOutput(t *testing.T) {
+	cfg := writeSite(t, incrementalFixture())
+	s, _ := buildSite(t, cfg, 1)
+	want := readOutput(t, s, "contact")
+
+	if err := os.WriteFile(s.PageOutputPath("contact"), []byte("edited by hand"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s, result := buildSite(t, cfg, 1)
+	requireNoErrors(t, result.Diagnostics)
+	requirePages(t, result, "contact")
+	if got := readOutput(t, s, "contact"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestIncrementalBuildFallsBackToFullBuild(t *testing.T) {
+	t.Run("config", func(t *testing.T) {
+		cfg := writeSite(t, incrementalFixture())
+		buildSite(t, cfg, 1)
+
+		data, err := os.ReadFile(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		editSite(t, cfg, map[string]string{"config.yml": string(data) + "maxIncludeDepth: 50\n"})
+		s, result := buildSite(t, cfg, 1)
+		if !result.Full || len(result.Pages) != len(s.Pages) {
+			t.Errorf("expected a full build, got %v", result.Pages)
+		}
+	})
+
+	t.Run("manifest version", func(t *testing.T) {
+		cfg := writeSite(t, incrementalFixture())
+		s, _ := buildSite(t, cfg, 1)
+
+		m, err := LoadManifest(s.ManifestPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Version = manifestVersion - 1
+		data, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(s.ManifestPath(), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		s, result := buildSite(t, cfg, 1)
+		if !result.Full || len(result.Pages) != len(s.Pages) {
+			t.Errorf("expected a full build, got %v", result.Pages)
+		}
+	})
+}
+
+func TestIncrementalBuildRemovesDeletedIncludeFiles(t *testing.T) {
+	cfg := writeSite(t, incrementalFixture())
+	s, _ := buildSite(t, cfg, 1)
+	asset := filepath.Join(s.BuildDir(), "style.css")
+	if _, err := os.Stat(asset); err != nil {
+		t.Fatal(err)
+	}
+
+	removeFromSite(t, cfg, "include/style.css")
+	_, result := buildSite(t, cfg, 1)
+	requireNoErrors(t, result.Diagnostics)
+	requirePages(t, result)
+	if !reflect.DeepEqual(result.Assets, []string{"style.css"}) {
+		t.Errorf("got %v assets, want [style.css]", result.Assets)
+	}
+	if _, err := os.Stat(asset); !os.IsNotExist(err) {
+		t.Errorf("style.css was not removed from the build directory: %v", err)
+	}
+}
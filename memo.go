@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// memoStore keeps the rendered output of fragments included from other fragments, so that a
+// fragment like a navigation bar is only evaluated once per distinct input instead of once per page.
+//
+// An entry is keyed on the fragment's name and source, the content it was passed, and whether it
+// was passed content at all. Because an included fragment can also read the shared metadata it
+// inherits from the including fragment, every entry records the keys it read and the values they
+// had; it is only reused when the inherited metadata still holds the same values for those keys.
+type memoStore struct {
+	mu      sync.Mutex
+	entries map[string][]*memoEntry
+}
+
+type memoEntry struct {
+	reads        map[string]string // Inherited shared meta keys read, and the fingerprint of their value
+	dependencies []Dependency
+	usage        *usageTracker
+	result       string
+}
+
+// memoRecord tracks an evaluation that may be memoized, while it is in progress.
+type memoRecord struct {
+	inherited    *CoreTable
+	reads        map[string]string
+	dependencies *DependencySet
+	usage        *usageTracker
+	cacheable    bool
+}
+
+func newMemoStore() *memoStore {
+	return &memoStore{entries: make(map[string][]*memoEntry)}
+}
+
+// reset drops every entry. Entries only hold as long as the sources they were rendered from do not
+// change, so the store is reset before every build.
+func (m *memoStore) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries = make(map[string][]*memoEntry)
+}
+
+func (m *memoStore) lookup(key string, inherited *CoreTable) *memoEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+entries:
+	for _, e := range m.entries[key] {
+		for k, fp := range e.reads {
+			if metaFingerprint(getNestedValue(inherited, k)) != fp {
+				continue entries
+			}
+		}
+		return e
+	}
+	return nil
+}
+
+func (m *memoStore) store(key string, e *memoEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[key] = append(m.entries[key], e)
+}
+
+func memoKey(f *Fragment, content string, hasContent bool, slots, props map[string]string) string {
+	mode := "0"
+	if hasContent {
+		mode = "1"
+	}
+	key := f.Name + "\x00" + f.sourceOrCode().Hash + "\x00" + mode + hashBytes([]byte(content))
+	key += memoKeyValues("slot:", slots)
+	key += memoKeyValues("prop:", props)
+	return key
+}
+
+// memoKeyValues returns the part of a memo key for the named blocks or props passed to a fragment.
+func memoKeyValues(prefix string, values map[string]string) string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var key string
+	for _, name := range names {
+		key += "\x00" + prefix + name + "=" + hashBytes([]byte(values[name]))
+	}
+	return key
+}
+
+// metaFingerprint returns a string that is equal for two metadata values exactly when they hold
+// the same data. Functions and userdata are compared by identity.
+func metaFingerprint(v CoreType) string {
+	switch v := v.(type) {
+	case nil, *CoreNil:
+		return "nil"
+	case *CoreBool:
+		return strconv.FormatBool(v.v)
+	case *CoreNumber:
+		return "n" + strconv.FormatFloat(v.v, 'g', -1, 64)
+	case *CoreString:
+		return strconv.Quote(v.v)
+	case *CoreTable:
+		keys := make([]string, 0, len(v.v))
+		for k := range v.v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		var b strings.Builder
+		b.WriteString("{")
+		for _, k := range keys {
+			b.WriteString(strconv.Quote(k))
+			b.WriteString("=")
+			b.WriteString(metaFingerprint(v.v[k]))
+			b.WriteString(",")
+		}
+		b.WriteString("}")
+		return b.String()
+	case *CoreFunction:
+		return fmt.Sprintf("f%p", v.v)
+	case *CoreUserData:
+		return fmt.Sprintf("u%p", v.v)
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// beginMemo starts tracking an evaluation that inherits the given shared metadata.
+func (r *RenderContext) beginMemo(inherited *CoreTable) *memoRecord {
+	rec := &memoRecord{
+		inherited:    inherited,
+		reads:        make(map[string]string),
+		dependencies: NewDependencySet(),
+		usage:        newUsageTracker(),
+		cacheable:    true,
+	}
+	r.memo = append(r.memo, rec)
+	return rec
+}
+
+func (r *RenderContext) endMemo() {
+	r.memo = r.memo[:len(r.memo)-1]
+}
+
+// ReadSharedMeta notes that a shared metadata key was read. Every evaluation in progress depends on
+// the value that key had in the metadata it inherited.
+func (r *RenderContext) ReadSharedMeta(key string) {
+	for _, rec := range r.memo {
+		if _, ok := rec.reads[key]; !ok {
+			rec.reads[key] = metaFingerprint(getNestedValue(rec.inherited, key))
+		}
+	}
+}
+
+// AddDependency records a dependency of the page, of every fragment of the include chain, and of
+// every evaluation in progress so that it can be recorded again when the evaluation is reused.
+func (r *RenderContext) AddDependency(dep Dependency) {
+	r.Dependencies.Add(dep)
+	for _, frame := range r.includes {
+		frame.Fragment.dependencies.Add(dep)
+	}
+	for _, rec := range r.memo {
+		rec.dependencies.Add(dep)
+	}
+}
+
+// DefineBuilder records that a builder was registered, for the page and every evaluation in progress.
+func (r *RenderContext) DefineBuilder(name string, fn *lua.LFunction) {
+	r.usage.defineBuilder(name, fn)
+	for _, rec := range r.memo {
+		rec.usage.defineBuilder(name, fn)
+	}
+}
+
+// CallBuilder records that a builder was called, for the page and every evaluation in progress.
+func (r *RenderContext) CallBuilder(fn *lua.LFunction) {
+	r.usage.callBuilder(fn)
+	for _, rec := range r.memo {
+		rec.usage.callBuilder(fn)
+	}
+}
+
+// replayUsage records the builders a reused evaluation registered and called again.
+func (r *RenderContext) replayUsage(u *usageTracker) {
+	for proto, def := range u.defined {
+		r.usage.defined[proto] = def
+		for _, rec := range r.memo {
+			rec.usage.defined[proto] = def
+		}
+	}
+	for proto := range u.called {
+		r.usage.called[proto] = true
+		for _, rec := range r.memo {
+			rec.usage.called[proto] = true
+		}
+	}
+}
+
+// MarkUncacheable stops the evaluations in progress from being memoized, because their output
+// depends on something other than their source, content and inherited metadata.
+func (r *RenderContext) MarkUncacheable() {
+	for _, rec := range r.memo {
+		rec.cacheable = false
+	}
+}
+
+// Invoke evaluates a fragment included from of, reusing an earlier evaluation with the same inputs
+// if there is one. Content is only passed on if hasContent is set; slots holds the named blocks and
+// props the props.
+func (f *Fragment) Invoke(content string, hasContent bool, slots, props map[string]string, of *Fragment) string {
+	memo := f.FragmentCache.memo
+	if memo == nil {
+		return f.evaluateIncluded(content, hasContent, slots, props, of)
+	}
+
+	// A fragment evaluated without content starts out with empty shared metadata
+	inherited := NewEmptyCoreTable()
+	if passesInput(hasContent, slots, props) {
+		inherited = of.SharedMeta
+	}
+
+	key := memoKey(f, content, hasContent, slots, props)
+	if e := memo.lookup(key, inherited); e != nil {
+		for _, dep := range e.dependencies {
+			f.Render.AddDependency(dep)
+		}
+		for k := range e.reads {
+			f.Render.ReadSharedMeta(k)
+		}
+		f.Render.replayUsage(e.usage)
+		return e.result
+	}
+
+	before := metaFingerprint(inherited)
+	rec := f.Render.beginMemo(inherited)
+	result := f.evaluateIncluded(content, hasContent, slots, props, of)
+	f.Render.endMemo()
+
+	// Nested metadata tables are shared with the including fragment, so writing to one changes
+	// the including fragment as well. That cannot be replayed, so such evaluations are not kept.
+	if metaFingerprint(inherited) != before {
+		f.Render.MarkUncacheable()
+		return result
+	}
+	if !rec.cacheable {
+		return result
+	}
+
+	memo.store(key, &memoEntry{
+		reads:        rec.reads,
+		dependencies: rec.dependencies.List(),
+		usage:        rec.usage,
+		result:       result,
+	})
+	return result
+}
+
+func (f *Fragment) evaluateIncluded(content string, hasContent bool, slots, props map[string]string, of *Fragment) string {
+	if passesInput(hasContent, slots, props) {
+		return f.WithContent(content, hasContent, slots, props, of)
+	}
+	return f.Evaluate()
+}
+
+// passesInput reports whether an include passes anything to the fragment, in which case the
+// fragment inherits the shared metadata of the including fragment.
+func passesInput(hasContent bool, slots, props map[string]string) bool {
+	return hasContent || len(slots) > 0 || len(props) > 0
+}
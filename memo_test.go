@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// memoEntries returns the number of memoized evaluations of a fragment.
+func memoEntries(s *Site, name string) int {
+	n := 0
+	for key, entries := range s.Cache.memo.entries {
+		if strings.HasPrefix(key, name+"\x00") {
+			n += len(entries)
+		}
+	}
+	return n
+}
+
+func TestMemoReusesIncludesAcrossPages(t *testing.T) {
+	files := map[string]string{
+		"fragment/nav.frag": "~~~\n<nav>nav</nav>",
+		"page/a.frag":       "~~~\n@{nav}<p>a</p>",
+		"page/b.frag":       "~~~\n@{nav}<p>b</p>",
+	}
+	s, result := buildSite(t, writeSite(t, files), 1)
+	requireNoErrors(t, result.Diagnostics)
+
+	// A page that missed would have stored a second evaluation
+	if n := memoEntries(s, "nav"); n != 1 {
+		t.Errorf("expected one evaluation of nav, got %d", n)
+	}
+	for _, page := range []string{"a", "b"} {
+		if out := strings.Join(strings.Fields(readOutput(t, s, page)), " "); !strings.Contains(out, "<nav> nav </nav>") {
+			t.Errorf("page %s: got %s", page, out)
+		}
+	}
+}
+
+func TestMemoMissesWhenInheritedValueDiffers(t *testing.T) {
+	files := map[string]string{
+		"fragment/card.frag": "~~~\n<h1>${title}</h1>${CONTENT}",
+		"page/a.frag":        "this:setSharedMeta { title = \"Same\", other = \"a\" }\n~~~\n@{card [[<p>body</p>]]}",
+		"page/b.frag":        "this:setSharedMeta { title = \"Same\", other = \"b\" }\n~~~\n@{card [[<p>body</p>]]}",
+		"page/c.frag":        "this:setSharedMeta { title = \"Different\", other = \"c\" }\n~~~\n@{card [[<p>body</p>]]}",
+	}
+	s, result := buildSite(t, writeSite(t, files), 1)
+	requireNoErrors(t, result.Diagnostics)
+
+	// Only title is read, so a and b share an evaluation even though other differs
+	if n := memoEntries(s, "card"); n != 2 {
+		t.Errorf("expected two evaluations of card, got %d", n)
+	}
+	want := map[string]string{"a": "<h1> Same </h1>", "b": "<h1> Same </h1>", "c": "<h1> Different </h1>"}
+	for page, title := range want {
+		if out := strings.Join(strings.Fields(readOutput(t, s, page)), " "); !strings.Contains(out, title) {
+			t.Errorf("page %s: got %s, want %s", page, out, title)
+		}
+	}
+}
+
+func TestMemoSkipsUncacheableEvaluations(t *testing.T) {
+	tests := map[string]string{
+		"setCacheable": "this:setCacheable(false)\n~~~\n<p>x</p>",
+		"parent":       "local parent = this:parent()\n~~~\n<p>x</p>",
+		"module":       "local other = fragments:getFragment(\"other\")\n~~~\n<p>x</p>",
+	}
+	for name, source := range tests {
+		t.Run(name, func(t *testing.T) {
+			files := map[string]string{
+				"fragment/other.frag": "~~~\n<p>other</p>",
+				"fragment/box.frag":   source,
+				"page/a.frag":         "~~~\n@{box}@{other}",
+				"page/b.frag":         "~~~\n@{box}",
+			}
+			s, result := buildSite(t, writeSite(t, files), 1)
+			requireNoErrors(t, result.Diagnostics)
+			if n := memoEntries(s, "box"); n != 0 {
+				t.Errorf("expected box not to be memoized, got %d evaluations", n)
+			}
+			if n := memoEntries(s, "other"); n != 1 {
+				t.Errorf("expected other to be memoized once, got %d evaluations", n)
+			}
+		})
+	}
+}
+
+func TestMemoHitReplaysDependenciesAndBuilders(t *testing.T) {
+	files := map[string]string{
+		"fragment/inner.frag": "~~~\n<b>inner</b>",
+		"fragment/nav.frag": "this:addBuilders {\n" +
+			"    shout = function(content) return content .. \"!\" end,\n" +
+			"    unused = function(content) return content end,\n" +
+			"}\n~~~\n<nav>*{shout[[hi]]}@{inner}</nav>",
+		"page/a.frag": "~~~\n@{nav}<p>a</p>",
+		"page/b.frag": "~~~\n@{nav}<p>b</p>",
+	}
+	s, result := buildSite(t, writeSite(t, files), 1)
+	requireNoErrors(t, result.Diagnostics)
+	if n := memoEntries(s, "nav"); n != 1 {
+		t.Fatalf("expected one evaluation of nav, got %d", n)
+	}
+
+	for _, page := range []string{"a", "b"} {
+		render := s.Pages[page].Render
+		if !render.Dependencies.Has(Dependency{DEP_FRAGMENT, "inner"}) {
+			t.Errorf("page %s does not depend on inner, got %v", page, render.Dependencies.List())
+		}
+		if defined, called := len(render.usage.defined), len(render.usage.called); defined != 2 || called != 1 {
+			t.Errorf("page %s: got %d builders defined and %d called, want 2 and 1", page, defined, called)
+		}
+	}
+	want := "Builder `unused` is never called"
+	if got := lintWarnings(result.Diagnostics, RULE_UNUSED_BUILDER); len(got) != 1 || got[0] != want {
+		t.Errorf("got %q, want [%q]", got, want)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/yosssi/gohtml"
+)
+
+// onDemandServer renders pages when they are requested instead of building the whole site up front.
+// Nothing is written to the build directory: pages are evaluated straight from the page directory
+// and include assets are served from the source. Evaluated pages stay in the fragment cache until a
+// source file changes, so listings only pay for discovering pages once.
+type onDemandServer struct {
+	mu       sync.Mutex
+	site     *Site
+	broker   *liveReloadBroker
+	interval time.Duration
+}
+
+func newOnDemandSite(configPath string) (*Site, error) {
+	cfg, err := GetConfiguration(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	cache := NewFragmentCache(cfg)
+	cache.LazyPages = true
+	return &Site{
+		ConfigPath: configPath,
+		Config:     cfg,
+		Cache:      cache,
+		Pages:      make(map[string]*Fragment),
+	}, nil
+}
+
+// renderPage evaluates a single page. ok is false if the page does not exist.
+func (o *onDemandServer) renderPage(name string) (html string, errs []error, ok bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if info, err := os.Stat(o.site.PageSourcePath(name)); err != nil || info.IsDir() {
+		return "", nil, false
+	}
+
+	log.Info("Rendering page", "name", name)
+	f, err := GetFragmentFromName(name, PAGE, o.site.Cache)
+	if err != nil {
+		return "", []error{err}, true
+	}
+	res := f.Evaluate()
+	return gohtml.Format(res), f.Render.Errors, true
+}
+
+func (o *onDemandServer) includeDir() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.site.IncludeDir()
+}
+
+func (o *onDemandServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	name := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") {
+		name = path.Join(name, "index.html")
+	}
+
+	// Include-directory assets are served straight from the source
+	if file, err := http.Dir(o.includeDir()).Open(name); err == nil {
+		defer file.Close()
+		if info, err := file.Stat(); err == nil && !info.IsDir() {
+			http.ServeContent(w, r, name, info.ModTime(), file)
+			return
+		}
+	}
+
+	page := strings.TrimPrefix(name, "/")
+	if ext := path.Ext(page); ext == ".html" {
+		page = strings.TrimSuffix(page, ext)
+	} else if ext != "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	html, errs, ok := o.renderPage(page)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	snippet := liveReloadScript
+	if len(errs) > 0 {
+		snippet = renderErrorOverlay(page, errs) + snippet
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(injectBeforeBodyClose([]byte(html), snippet))
+}
+
+// watch drops every cached evaluation whenever a source file changes and tells connected browsers
+// to pick up the change.
+func (o *onDemandServer) watch() {
+	o.mu.Lock()
+	snap := snapshotFiles(o.site.watchedPaths()...)
+	o.mu.Unlock()
+
+	for {
+		time.Sleep(o.interval)
+
+		o.mu.Lock()
+		next := snapshotFiles(o.site.watchedPaths()...)
+		changed := changedFiles(snap, next)
+		snap = next
+
+		var result RebuildResult
+		for _, p := range changed {
+			if rel, ok := relativeTo(o.site.IncludeDir(), p); ok {
+				result.Assets = append(result.Assets, rel)
+			} else {
+				result.Full = true
+			}
+		}
+
+		if result.Full {
+			site, err := newOnDemandSite(o.site.ConfigPath)
+			if err != nil {
+				log.Error("Failed to read configuration", "path", o.site.ConfigPath, "error", err)
+			} else {
+				o.site = site
+				snap = snapshotFiles(o.site.watchedPaths()...)
+			}
+		}
+		o.mu.Unlock()
+
+		if len(changed) > 0 {
+			log.Info("Change detected", "files", len(changed))
+			o.broker.publishRebuild(result)
+		}
+	}
+}
+
+func serveOnDemand(siteConfigPath string, addr string, interval time.Duration) {
+	site, err := newOnDemandSite(siteConfigPath)
+	if err != nil {
+		log.Error("Failed to read configuration", "path", siteConfigPath, "error", err)
+		os.Exit(1)
+	}
+
+	o := &onDemandServer{
+		site:     site,
+		broker:   newLiveReloadBroker(),
+		interval: interval,
+	}
+	go o.watch()
+
+	mux := http.NewServeMux()
+	mux.Handle(liveReloadPath, o.broker)
+	mux.Handle("/", o)
+
+	log.Info("Serving site on demand", "url", "http://"+displayAddr(addr), "pages", site.PageDir())
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Error("Server stopped", "error", err)
+		os.Exit(1)
+	}
+}
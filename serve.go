@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+const liveReloadPath = "/__fragments/events"
+
+// liveReloadScript is injected into every HTML page served in development. It listens for rebuild
+// events and either reloads the page or, for stylesheet-only changes, swaps the affected <link> tags.
+const liveReloadScript = `<script>
+(function () {
+  var source = new EventSource("` + liveReloadPath + `");
+  source.addEventListener("reload", function () {
+    location.reload();
+  });
+  source.addEventListener("css", function (event) {
+    var changed = JSON.parse(event.data);
+    document.querySelectorAll('link[rel="stylesheet"]').forEach(function (link) {
+      var url = new URL(link.href);
+      if (url.origin !== location.origin || changed.indexOf(url.pathname.replace(/^\//, "")) === -1) {
+        return;
+      }
+      url.searchParams.set("fragments-reload", Date.now());
+      var next = link.cloneNode();
+      next.href = url.toString();
+      next.onload = function () { link.remove(); };
+      link.parentNode.insertBefore(next, link.nextSibling);
+    });
+  });
+})();
+</script>
+`
+
+type liveReloadEvent struct {
+	Name string
+	Data string
+}
+
+// liveReloadBroker fans rebuild notifications out to every connected browser.
+type liveReloadBroker struct {
+	mu      sync.Mutex
+	clients map[chan liveReloadEvent]struct{}
+}
+
+func newLiveReloadBroker() *liveReloadBroker {
+	return &liveReloadBroker{clients: make(map[chan liveReloadEvent]struct{})}
+}
+
+func (b *liveReloadBroker) subscribe() chan liveReloadEvent {
+	ch := make(chan liveReloadEvent, 4)
+	b.mu.Lock()
+	b.clients[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *liveReloadBroker) unsubscribe(ch chan liveReloadEvent) {
+	b.mu.Lock()
+	delete(b.clients, ch)
+	b.mu.Unlock()
+}
+
+func (b *liveReloadBroker) publish(ev liveReloadEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.clients {
+		select {
+		case ch <- ev:
+		default:
+			// The browser is not keeping up; it will catch up on the next event
+		}
+	}
+}
+
+// publishRebuild tells browsers how to pick up a finished rebuild. Stylesheet-only changes are
+// swapped in place, anything else reloads the page.
+func (b *liveReloadBroker) publishRebuild(result RebuildResult) {
+	if result.Full || len(result.Pages) > 0 || len(result.Removed) > 0 {
+		b.publish(liveReloadEvent{Name: "reload", Data: "{}"})
+		return
+	}
+	if len(result.Assets) == 0 {
+		return
+	}
+	for _, asset := range result.Assets {
+		if path.Ext(asset) != ".css" {
+			b.publish(liveReloadEvent{Name: "reload", Data: "{}"})
+			return
+		}
+	}
+	data, _ := json.Marshal(result.Assets)
+	b.publish(liveReloadEvent{Name: "css", Data: string(data)})
+}
+
+func (b *liveReloadBroker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher.Flush()
+
+	ch := b.subscribe()
+	defer b.unsubscribe(ch)
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case ev := <-ch:
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Name, ev.Data)
+		}
+		flusher.Flush()
+	}
+}
+
+// injectBeforeBodyClose inserts snippet before the closing </body> tag, or at the end of the
+// document if there is none.
+func injectBeforeBodyClose(html []byte, snippet string) []byte {
+	idx := bytes.LastIndex(bytes.ToLower(html), []byte("</body>"))
+	if idx < 0 {
+		return append(html, snippet...)
+	}
+	out := make([]byte, 0, len(html)+len(snippet))
+	out = append(out, html[:idx]...)
+	out = append(out, snippet...)
+	return append(out, html[idx:]...)
+}
+
+// errorOverlays keeps the rendered error overlay of every page that failed in the latest build.
+type errorOverlays struct {
+	mu    sync.Mutex
+	pages map[string]string
+}
+
+func newErrorOverlays() *errorOverlays {
+	return &errorOverlays{pages: make(map[string]string)}
+}
+
+func (o *errorOverlays) update(result RebuildResult) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if result.Full {
+		o.pages = make(map[string]string)
+	}
+	for _, name := range result.Removed {
+		delete(o.pages, name)
+	}
+	for _, name := range result.Pages {
+		if errs := result.Errors[name]; len(errs) > 0 {
+			o.pages[name] = renderErrorOverlay(name, errs)
+		} else {
+			delete(o.pages, name)
+		}
+	}
+}
+
+func (o *errorOverlays) get(page string) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.pages[page]
+}
+
+// buildDirHandler serves the build directory, injecting the live reload client and, for pages that
+// failed to build, the error overlay into HTML pages. The directory is fixed when the server
+// starts; moving it in config.yml requires a restart.
+type buildDirHandler struct {
+	dir      string
+	overlays *errorOverlays
+}
+
+func (h *buildDirHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	name := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") {
+		name = path.Join(name, "index.html")
+	}
+
+	dir := http.Dir(h.dir)
+	file, err := dir.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if info.IsDir() {
+		http.Redirect(w, r, path.Join(r.URL.Path, "index.html"), http.StatusFound)
+		return
+	}
+
+	if filepath.Ext(name) != ".html" {
+		http.ServeContent(w, r, name, info.ModTime(), file)
+		return
+	}
+
+	html, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page := strings.TrimSuffix(strings.TrimPrefix(name, "/"), ".html")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(injectBeforeBodyClose(html, h.overlays.get(page)+liveReloadScript))
+}
+
+func serve(siteConfigPath string, addr string, interval time.Duration, jobs int) {
+	site, err := LoadSite(siteConfigPath)
+	if err != nil {
+		log.Error("Failed to read configuration", "path", siteConfigPath, "error", err)
+		os.Exit(1)
+	}
+	site.Jobs = jobs
+	overlays := newErrorOverlays()
+	overlays.update(site.Build())
+
+	broker := newLiveReloadBroker()
+	go site.Watch(interval, func(result RebuildResult) {
+		overlays.update(result)
+		broker.publishRebuild(result)
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle(liveReloadPath, broker)
+	mux.Handle("/", &buildDirHandler{dir: site.BuildDir(), overlays: overlays})
+
+	log.Info("Serving site", "url", "http://"+displayAddr(addr), "dir", site.BuildDir())
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Error("Server stopped", "error", err)
+		os.Exit(1)
+	}
+}
+
+// displayAddr turns a listen address such as ":8080" into something that can be opened in a browser.
+func displayAddr(addr string) string {
+	if strings.HasPrefix(addr, ":") {
+		return "localhost" + addr
+	}
+	return addr
+}
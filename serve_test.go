@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPublishRebuild(t *testing.T) {
+	tests := []struct {
+		name   string
+		result RebuildResult
+		want   *liveReloadEvent
+	}{
+		{"stylesheets", RebuildResult{Assets: []string{"css/site.css", "theme.css"}}, &liveReloadEvent{Name: "css", Data: `["css/site.css","theme.css"]`}},
+		{"stylesheet and image", RebuildResult{Assets: []string{"site.css", "logo.png"}}, &liveReloadEvent{Name: "reload", Data: "{}"}},
+		{"stylesheet and page", RebuildResult{Pages: []string{"index"}, Assets: []string{"site.css"}}, &liveReloadEvent{Name: "reload", Data: "{}"}},
+		{"removed page", RebuildResult{Removed: []string{"old"}}, &liveReloadEvent{Name: "reload", Data: "{}"}},
+		{"full build", RebuildResult{Full: true}, &liveReloadEvent{Name: "reload", Data: "{}"}},
+		{"nothing", RebuildResult{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newLiveReloadBroker()
+			ch := b.subscribe()
+			b.publishRebuild(tt.result)
+
+			var got *liveReloadEvent
+			select {
+			case ev := <-ch:
+				got = &ev
+			default:
+			}
+			switch {
+			case got == nil && tt.want != nil:
+				t.Errorf("no event, want %+v", *tt.want)
+			case got != nil && tt.want == nil:
+				t.Errorf("got %+v, want no event", *got)
+			case got != nil && *got != *tt.want:
+				t.Errorf("got %+v, want %+v", *got, *tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/charmbracelet/log"
+	"github.com/yosssi/gohtml"
+)
+
+// Site is a loaded project: its configuration, the fragment cache and the pages found on disk.
+type Site struct {
+	ConfigPath string
+	Config     *Config
+	Cache      *FragmentCache
+	Pages      map[string]*Fragment
+
+	// Jobs is the number of pages evaluated in parallel. Zero uses one worker per CPU.
+	Jobs int
+
+	// Force ignores the manifest of the previous build and renders every page.
+	Force bool
+
+	// FailFast stops handing out pages to render as soon as one page fails.
+	FailFast bool
+
+	// Diagnostics collects the errors and warnings of the latest build or rebuild.
+	Diagnostics *Diagnostics
+
+	manifest *Manifest
+}
+
+func LoadSite(configPath string) (*Site, error) {
+	cfg, err := GetConfiguration(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Site{
+		ConfigPath: configPath,
+		Config:     cfg,
+		Cache:      NewFragmentCache(cfg),
+	}
+	s.Pages = RecursivelyFindPages(s.PageDir(), s.Cache)
+	return s, nil
+}
+
+func (s *Site) PageDir() string {
+	return filepath.Join(s.Config.SiteRoot, s.Config.PagePath)
+}
+
+func (s *Site) FragmentDir() string {
+	return filepath.Join(s.Config.SiteRoot, s.Config.FragmentsPath)
+}
+
+func (s *Site) IncludeDir() string {
+	return filepath.Join(s.Config.SiteRoot, s.Config.IncludePath)
+}
+
+func (s *Site) BuildDir() string {
+	return filepath.Join(s.Config.SiteRoot, s.Config.BuildPath)
+}
+
+// PageSourcePath returns the .frag file a page is read from.
+func (s *Site) PageSourcePath(name string) string {
+	return filepath.Join(s.PageDir(), filepath.FromSlash(name)+".frag")
+}
+
+// PageOutputPath returns the HTML file a page is written to.
+func (s *Site) PageOutputPath(name string) string {
+	return filepath.Join(s.BuildDir(), filepath.FromSlash(name)+".html")
+}
+
+// Build brings the build directory up to date. The manifest of the previous build is used to
+// render only the pages whose sources or dependencies changed, and to remove the output of pages
+// that were deleted. If there is no usable manifest, or Force is set, every page is rendered.
+func (s *Site) Build() RebuildResult {
+	s.Diagnostics = NewDiagnostics()
+
+	buildDir := s.BuildDir()
+	if err := os.MkdirAll(buildDir, os.ModePerm); err != nil {
+		log.Error("Failed to create build dir", "dir", buildDir, "error", err)
+		s.Diagnostics.Report("", SEVERITY_ERROR, err)
+	}
+
+	current := s.scanSources()
+	var prev *Manifest
+	if !s.Force {
+		prev = s.previousManifest(current)
+	}
+
+	result := RebuildResult{Full: prev == nil, Diagnostics: s.Diagnostics}
+	s.copyAssets(prev, current, &result)
+
+	if prev == nil {
+		result.Pages = sortedNames(s.Pages)
+	} else {
+		for _, name := range s.stalePages(prev, current) {
+			if _, ok := s.Pages[name]; ok {
+				result.Pages = append(result.Pages, name)
+			}
+		}
+		current.carryOver(prev)
+		for name := range prev.Pages {
+			if _, ok := s.Pages[name]; ok {
+				continue
+			}
+			if err := os.Remove(s.PageOutputPath(name)); err != nil && !os.IsNotExist(err) {
+				log.Error("Failed to remove page", "file", s.PageOutputPath(name), "error", err)
+				s.Diagnostics.Report("", SEVERITY_ERROR, err)
+			}
+			result.Removed = append(result.Removed, name)
+		}
+		sort.Strings(result.Removed)
+	}
+
+	render := make(map[string]*Fragment, len(result.Pages))
+	for _, name := range result.Pages {
+		render[name] = s.Pages[name]
+	}
+
+	// Listings on the rendered pages need the metadata of every page, not just the stale ones
+	s.collectMeta(s.Pages)
+	errs, outputs := s.renderPages(render)
+	result.Errors = errs
+
+	current.recordPages(render, outputs, errs)
+	s.manifest = current
+	s.saveManifest()
+
+	// Pages that failed may not have reached everything they use, which would make the warnings wrong
+	if !s.Diagnostics.HasErrors() {
+		s.lint(current)
+	}
+
+	s.Diagnostics.PrintSummary()
+	log.Info("Build finished", "rendered", len(outputs), "skipped", len(result.Pages)-len(outputs), "unchanged", len(s.Pages)-len(result.Pages), "removed", len(result.Removed), "errors", s.Diagnostics.Count(SEVERITY_ERROR), "warnings", s.Diagnostics.Count(SEVERITY_WARNING))
+	return result
+}
+
+// copyAssets copies the include directory into the build directory. With a previous manifest only
+// new and changed files are copied, and files that were deleted are removed from the build directory.
+func (s *Site) copyAssets(prev, current *Manifest, result *RebuildResult) {
+	includeDir := s.IncludeDir()
+	if prev == nil {
+		if info, err := os.Stat(includeDir); err == nil && info.IsDir() {
+			if err := copyDir(includeDir, s.BuildDir()); err != nil {
+				log.Error("Failed to copy include directory", "error", err)
+				s.Diagnostics.Report("", SEVERITY_ERROR, err)
+			}
+		} else {
+			log.Debug("Include directory not found or not a directory", "path", includeDir)
+		}
+		return
+	}
+
+	for rel, hash := range current.Assets {
+		if prev.Assets[rel] == hash {
+			continue
+		}
+		src := filepath.Join(includeDir, filepath.FromSlash(rel))
+		if err := copyFile(src, filepath.Join(s.BuildDir(), filepath.FromSlash(rel))); err != nil {
+			log.Error("Failed to copy asset", "file", src, "error", err)
+			s.Diagnostics.Report("", SEVERITY_ERROR, err)
+		}
+		result.Assets = append(result.Assets, rel)
+	}
+	for rel := range prev.Assets {
+		if _, ok := current.Assets[rel]; ok {
+			continue
+		}
+		dst := filepath.Join(s.BuildDir(), filepath.FromSlash(rel))
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+			log.Error("Failed to remove asset", "file", dst, "error", err)
+			s.Diagnostics.Report("", SEVERITY_ERROR, err)
+		}
+		result.Assets = append(result.Assets, rel)
+	}
+	sort.Strings(result.Assets)
+}
+
+func (s *Site) saveManifest() {
+	if s.manifest == nil {
+		return
+	}
+	if err := s.manifest.Save(s.ManifestPath()); err != nil {
+		log.Error("Failed to write build manifest", "file", s.ManifestPath(), "error", err)
+	}
+}
+
+// buildPages evaluates the given pages and writes each of them to the build directory. It returns
+// the errors raised by each page that failed, and the hash of the output written for each page.
+func (s *Site) buildPages(pages map[string]*Fragment) (map[string][]error, map[string]string) {
+	// Sources may have changed since the last build, so memoized fragments cannot be reused
+	s.Cache.memo.reset()
+	s.collectMeta(pages)
+	return s.renderPages(pages)
+}
+
+// collectMeta runs the Lua section of every given page, so that listings see the complete set of
+// pages before any page is rendered. Errors are not logged here: the Lua section runs again when
+// the page is rendered, which reports them.
+func (s *Site) collectMeta(pages map[string]*Fragment) {
+	s.forEachPage(pages, func(_ string, v *Fragment) {
+		v.Render.quiet = true
+		v.EvaluateMeta()
+		v.Render.quiet = false
+	})
+}
+
+func (s *Site) renderPages(pages map[string]*Fragment) (map[string][]error, map[string]string) {
+	var mu sync.Mutex
+	errs := make(map[string][]error)
+	outputs := make(map[string]string)
+	s.forEachPage(pages, func(k string, v *Fragment) {
+		log.Info("Building page", "name", k)
+		// The Lua section runs again while rendering, so only keep the errors from this phase
+		v.Render.Errors = nil
+		v.Render.Warnings = nil
+		res := gohtml.Format(v.Evaluate())
+		if err := s.writePage(k, res); err != nil {
+			v.Render.Errors = append(v.Render.Errors, err)
+		}
+		if s.Diagnostics != nil {
+			s.Diagnostics.ReportPage(k, v.Render)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if len(v.Render.Errors) > 0 {
+			errs[k] = v.Render.Errors
+		}
+		outputs[k] = hashBytes([]byte(res))
+	})
+
+	return errs, outputs
+}
+
+// forEachPage calls fn for every page on a pool of s.Jobs workers and waits for all of them to finish.
+// Pages are handed out in name order.
+func (s *Site) forEachPage(pages map[string]*Fragment, fn func(name string, f *Fragment)) {
+	jobs := s.Jobs
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+
+	names := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				fn(name, pages[name])
+			}
+		}()
+	}
+
+	for _, name := range sortedNames(pages) {
+		if s.FailFast && s.Diagnostics != nil && s.Diagnostics.HasErrors() {
+			log.Warn("Stopping the build after the first failing page")
+			break
+		}
+		names <- name
+	}
+	close(names)
+	wg.Wait()
+}
+
+func (s *Site) writePage(name string, res string) error {
+	dest := s.PageOutputPath(name)
+	if err := os.MkdirAll(filepath.Dir(dest), os.ModePerm); err != nil {
+		log.Error("Error creating directories", "dir", filepath.Dir(dest), "error", err)
+		return err
+	}
+	file, err := os.Create(dest)
+	if err != nil {
+		log.Error("Error creating file", "file", dest, "error", err)
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write([]byte(res)); err != nil {
+		log.Error("Error writing to file", "file", dest, "error", err)
+		return err
+	}
+	log.Info("Page built", "name", name, "out", dest)
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// parallelFixture is a site whose pages share fragments, a template and listings of each other,
+// so that pages evaluated at the same time read the same cache entries.
+func parallelFixture() map[string]string {
+	files := map[string]string{
+		"fragment/page.frag":   "~~~\n<html><body>@{nav}${CONTENT}@{footer[[${title}]]}</body></html>",
+		"fragment/footer.frag": "~~~\n<footer>${CONTENT}</footer>",
+		"fragment/nav.frag": `this:addBuilders {
+    links = function()
+        local pages, ids = fragments:getAllPages(), {}
+        for id in pairs(pages) do table.insert(ids, id) end
+        table.sort(ids)
+        local out = ""
+        for _, id in ipairs(ids) do
+            out = out .. "<a href='/" .. id .. "'>" .. tostring(pages[id]:getSharedMeta("title")) .. "</a>"
+        end
+        return out
+    end
+}
+~~~
+<nav>*{links}</nav>`,
+		"fragment/list.frag": `this:addBuilders {
+    posts = function()
+        local pages, ids = fragments:getPagesUnder("posts"), {}
+        for id in pairs(pages) do table.insert(ids, id) end
+        table.sort(ids)
+        local out = ""
+        for _, id in ipairs(ids) do
+            out = out .. "<li>" .. id .. ": " .. tostring(pages[id]:getSharedMeta("title")) .. "</li>"
+        end
+        return out
+    end
+}
+~~~
+<ul>*{posts}</ul>`,
+		"page/index.frag": "this:setTemplate(\"page\")\nthis:setSharedMeta { title = \"Home\" }\n~~~\n@{list}",
+	}
+	for i := 0; i < 24; i++ {
+		files[fmt.Sprintf("page/posts/p%02d.frag", i)] = fmt.Sprintf("this:setTemplate(\"page\")\nthis:setSharedMeta { title = \"Post %d\" }\n~~~\n<h1>${title}</h1>@{footer[[post %d]]}@{list}", i, i)
+	}
+	return files
+}
+
+// readBuild returns every file of the build directory by path.
+func readBuild(t *testing.T, s *Site) map[string]string {
+	t.Helper()
+	out := make(map[string]string)
+	err := filepath.Walk(s.BuildDir(), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(s.BuildDir(), path)
+		out[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestParallelBuildMatchesSerialBuild(t *testing.T) {
+	serial, result := buildSite(t, writeSite(t, parallelFixture()), 1)
+	requireNoErrors(t, result.Diagnostics)
+	want := readBuild(t, serial)
+	if len(want) != 25 {
+		t.Fatalf("serial build wrote %d files, want 25", len(want))
+	}
+
+	for run := 0; run < 5; run++ {
+		parallel, result := buildSite(t, writeSite(t, parallelFixture()), 8)
+		requireNoErrors(t, result.Diagnostics)
+		got := readBuild(t, parallel)
+		if len(got) != len(want) {
+			t.Fatalf("run %d: parallel build wrote %d files, want %d", run, len(got), len(want))
+		}
+		for name, content := range want {
+			if got[name] != content {
+				t.Errorf("run %d: %s differs from the serial build:\n--- serial\n%s\n--- parallel\n%s", run, name, content, got[name])
+			}
+		}
+	}
+}
+
+func TestListingsDoNotDependOnWhenPagesFinish(t *testing.T) {
+	files := map[string]string{
+		"fragment/list.frag": parallelFixture()["fragment/list.frag"],
+	}
+	var want string
+	for i := 0; i < 8; i++ {
+		// Pages are handed out in name order, and the first ones take the longest, so the
+		// workers finish them in roughly the opposite order
+		files[fmt.Sprintf("page/posts/p%d.frag", i)] = fmt.Sprintf("local n = 0\nfor i = 1, %d do n = n + 1 end\n"+
+			"this:setSharedMeta { title = \"Post %d\" }\n~~~\n@{list}", (8-i)*20000, i)
+		want += fmt.Sprintf("<li> p%d: Post %d </li> ", i, i)
+	}
+	want = "<ul> " + want + "</ul>"
+
+	for _, jobs := range []int{1, 8} {
+		s, result := buildSite(t, writeSite(t, files), jobs)
+		requireNoErrors(t, result.Diagnostics)
+		for i := 0; i < 8; i++ {
+			page := fmt.Sprintf("posts/p%d", i)
+			if got := strings.Join(strings.Fields(readOutput(t, s, page)), " "); got != want {
+				t.Errorf("%d jobs, %s: got %s, want %s", jobs, page, got, want)
+			}
+		}
+	}
+}
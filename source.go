@@ -0,0 +1,283 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Source is a .frag file as read from disk, along with what has been parsed from it so far. Sources
+// are shared by every fragment evaluated from the same file, so the content is only parsed once and
+// the Lua section is only compiled once, however many times the fragment is included.
+type Source struct {
+	Path    string
+	Code    string
+	Hash    string
+	LuaCode string
+	Content string
+
+	contentPos sourcePos // Where Content starts in Code
+
+	modTime time.Time
+	size    int64
+
+	mu     sync.Mutex
+	proto  *lua.FunctionProto
+	luaErr error
+	nodes  []Node
+	parsed bool
+}
+
+// sourceCache holds the sources read so far, keyed by path. A source is read again once the
+// modification time or size of its file changes.
+type sourceCache struct {
+	mu    sync.Mutex
+	files map[string]*Source
+}
+
+func newSourceCache() *sourceCache {
+	return &sourceCache{files: make(map[string]*Source)}
+}
+
+func (c *sourceCache) load(path string) (*Source, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	src, ok := c.files[path]
+	c.mu.Unlock()
+	if ok && src.modTime.Equal(info.ModTime()) && src.size == info.Size() {
+		return src, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	src = newSource(path, string(b))
+	src.modTime = info.ModTime()
+	src.size = info.Size()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files[path] = src
+	return src, nil
+}
+
+// all returns every source read so far.
+func (c *sourceCache) all() []*Source {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sources := make([]*Source, 0, len(c.files))
+	for _, src := range c.files {
+		sources = append(sources, src)
+	}
+	return sources
+}
+
+func newSource(path string, code string) *Source {
+	luaCode, content, contentStart := splitCode(code)
+	return &Source{
+		Path:       path,
+		Code:       code,
+		Hash:       hashBytes([]byte(code)),
+		LuaCode:    luaCode,
+		Content:    content,
+		contentPos: positionAt(code, contentStart),
+	}
+}
+
+// splitCode splits a fragment into its lua and content parts, separated by '~~~'. The lua part
+// keeps its leading whitespace, so that line numbers in Lua errors match the lines of the file.
+// contentStart is the byte offset of the content in code.
+func splitCode(code string) (luaCode string, content string, contentStart int) {
+	parts := strings.SplitN(code, "~~~", 2)
+	if len(parts) >= 2 {
+		luaCode = parts[0]
+		content = parts[1]
+		contentStart = len(parts[0]) + len("~~~")
+	} else {
+		luaCode = ""
+		content = parts[0]
+	}
+	if strings.TrimSpace(luaCode) == "" {
+		luaCode = ""
+	}
+
+	// Strip leading and trailing whitespace from content
+	trimmed := strings.TrimLeftFunc(content, unicode.IsSpace)
+	contentStart += len(content) - len(trimmed)
+	return luaCode, strings.TrimRightFunc(trimmed, unicode.IsSpace), contentStart
+}
+
+// positionAt returns the line and column of a byte offset in code. Columns count runes.
+func positionAt(code string, offset int) sourcePos {
+	before := code[:offset]
+	lineStart := strings.LastIndexByte(before, '\n') + 1
+	return sourcePos{
+		Line:   strings.Count(before, "\n") + 1,
+		Column: utf8.RuneCountInString(before[lineStart:]) + 1,
+	}
+}
+
+// luaChunkName is the chunk name a Lua section is compiled with. Lua uses it in error messages
+// and tracebacks, which lets luaError map them back to the file.
+func luaChunkName(path string) string {
+	if path == "" {
+		return "<string>"
+	}
+	return path
+}
+
+// compileLua compiles a Lua chunk the same way LState.DoString does, so that errors read the same.
+func compileLua(code string, name string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(code), name)
+	if err != nil {
+		return nil, &lua.ApiError{Type: lua.ApiErrorSyntax, Object: lua.LString(err.Error()), Cause: err}
+	}
+	proto, err := lua.Compile(chunk, name)
+	if err != nil {
+		return nil, &lua.ApiError{Type: lua.ApiErrorSyntax, Object: lua.LString(err.Error()), Cause: err}
+	}
+	return proto, nil
+}
+
+// Proto returns the compiled Lua section. The result is shared, including a compile error.
+func (s *Source) Proto() (*lua.FunctionProto, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.proto == nil && s.luaErr == nil {
+		s.proto, s.luaErr = compileLua(s.LuaCode, luaChunkName(s.Path))
+	}
+	return s.proto, s.luaErr
+}
+
+// Nodes returns the parsed content. Parse errors are not kept: they name the fragment being
+// evaluated, so the content is parsed again for every fragment that runs into one.
+func (s *Source) Nodes(f *Fragment) ([]Node, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.parsed {
+		return s.nodes, nil
+	}
+	nodes, err := ParseCodeAt(s.Content, f, s.contentPos)
+	if err != nil {
+		return nil, err
+	}
+	s.nodes = nodes
+	s.parsed = true
+	return nodes, nil
+}
+
+// sourceOrCode returns the fragment's source, or one made from its code if it was not read from a file.
+func (f *Fragment) sourceOrCode() *Source {
+	if f.source != nil {
+		return f.source
+	}
+	f.source = newSource(f.Path, f.Code)
+	return f.source
+}
+
+// runLua runs the fragment's Lua section in L with env as its environment, if it has one.
+func (f *Fragment) runLua(L *lua.LState, env *lua.LTable) error {
+	src := f.sourceOrCode()
+	if src.LuaCode == "" {
+		return nil
+	}
+
+	proto, err := src.Proto()
+	if err != nil {
+		return f.luaError(err)
+	}
+	fn := L.NewFunctionFromProto(proto)
+	fn.Env = env
+	L.Push(fn)
+	if err := L.PCall(0, 0, nil); err != nil {
+		return f.luaError(err)
+	}
+	return nil
+}
+
+var (
+	luaSyntaxPosition  = regexp.MustCompile(`line:(\d+)\(column:(\d+)\)`)
+	luaRuntimePosition = regexp.MustCompile(`^(.+?\.frag|<string>):(\d+): `)
+	luaTracePosition   = regexp.MustCompile(`(?m)^\t(.+?\.frag|<string>):(\d+): (.*)$`)
+)
+
+// luaError converts an error returned by the Lua VM into a LuaError pointing at the line of the
+// .frag file it was raised in. That is usually f's own file, but a builder or function defined by
+// another fragment reports the file it was defined in.
+func (f *Fragment) luaError(err error) *LuaError {
+	le := &LuaError{Fragment: f, Path: f.Path, Code: f.Code, Cause: err, Message: err.Error()}
+
+	var ae *lua.ApiError
+	if !errors.As(err, &ae) {
+		return le
+	}
+
+	// Syntax errors from compileLua keep the parse error as their cause
+	var pe *parse.Error
+	if errors.As(ae.Cause, &pe) {
+		le.Message = strings.TrimSpace(pe.Message)
+		if pe.Pos.Line > 0 {
+			le.Line, le.Column = pe.Pos.Line, pe.Pos.Column
+			le.Message += fmt.Sprintf(" near '%s'", pe.Token)
+		}
+		return le
+	}
+	if ae.Object == nil {
+		return le
+	}
+	le.Message = strings.TrimSpace(ae.Object.String())
+	trace := luaTracePosition.FindAllStringSubmatch(ae.StackTrace, -1)
+
+	if m := luaSyntaxPosition.FindStringSubmatch(le.Message); m != nil {
+		le.Line, _ = strconv.Atoi(m[1])
+		le.Column, _ = strconv.Atoi(m[2])
+	} else if m := luaRuntimePosition.FindStringSubmatch(le.Message); m != nil {
+		le.Line, _ = strconv.Atoi(m[2])
+		le.Message = strings.TrimPrefix(le.Message, m[0])
+		le.setPath(m[1])
+	} else if len(trace) > 0 {
+		le.Line, _ = strconv.Atoi(trace[0][2])
+		le.setPath(trace[0][1])
+	}
+
+	// Keep the traceback when the error went through more than one function of a .frag file
+	if len(trace) > 1 {
+		var sb strings.Builder
+		sb.WriteString(le.Message)
+		sb.WriteString("\nstack traceback:")
+		for _, m := range trace {
+			sb.WriteString(fmt.Sprintf("\n    %s:%s: %s", f.relativePath(m[1]), m[2], m[3]))
+		}
+		le.Message = sb.String()
+	}
+	return le
+}
+
+// setPath points the error at another .frag file than the one of the fragment being evaluated.
+func (e *LuaError) setPath(chunk string) {
+	if chunk == "<string>" || chunk == e.Path {
+		return
+	}
+	e.Path = chunk
+	e.Code = ""
+	if e.Fragment.FragmentCache != nil {
+		if src, err := e.Fragment.FragmentCache.sources.load(chunk); err == nil {
+			e.Code = src.Code
+		}
+	}
+}
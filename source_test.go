@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSourceCacheReadsChangedFilesAgain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nav.frag")
+	mtime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	write := func(code string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(code), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	load := func(c *sourceCache, want string) *Source {
+		t.Helper()
+		src, err := c.load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if src.Code != want {
+			t.Fatalf("got %q, want %q", src.Code, want)
+		}
+		return src
+	}
+
+	c := newSourceCache()
+	write("~~~\n<nav>a</nav>", mtime)
+	first := load(c, "~~~\n<nav>a</nav>")
+	if again := load(c, "~~~\n<nav>a</nav>"); again != first {
+		t.Error("an unchanged file was read again")
+	}
+
+	// Same size, newer modification time
+	write("~~~\n<nav>b</nav>", mtime.Add(time.Second))
+	second := load(c, "~~~\n<nav>b</nav>")
+	if second == first {
+		t.Error("a file with a new modification time was not read again")
+	}
+
+	// Same modification time, different size
+	write("~~~\n<nav>longer</nav>", mtime.Add(time.Second))
+	if third := load(c, "~~~\n<nav>longer</nav>"); third == second {
+		t.Error("a file with a new size was not read again")
+	}
+}
+
+func TestLuaErrorPointsAtFragmentDefiningBuilder(t *testing.T) {
+	files := map[string]string{
+		"fragment/tools.frag": "this:addBuilders {\n" +
+			"    fail = function(content)\n" +
+			"        error(\"cannot build \" .. content)\n" +
+			"    end,\n" +
+			"}\n~~~\n",
+		"page/index.frag": "local tools = fragments:getBuilders(\"fragment\", \"tools\")\n" +
+			"this:setLocalMeta { text = tools.fail(\"x\") }\n~~~\n<p>${text}</p>",
+	}
+	_, d := renderPage(t, files, "index")
+	requireError(t, d, "cannot build x")
+
+	for _, item := range d.Items() {
+		le, ok := item.Err.(*LuaError)
+		if !ok {
+			continue
+		}
+		if filepath.Base(le.Path) != "tools.frag" || le.Line != 3 {
+			t.Errorf("got %s:%d, want tools.frag:3", le.Path, le.Line)
+		}
+		if !strings.Contains(le.Code, "cannot build") {
+			t.Errorf("the error does not show the code of tools.frag: %q", le.Code)
+		}
+		return
+	}
+	t.Fatal("expected a Lua error")
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxSuggestions is the number of names offered for an unknown fragment, builder or meta key.
+const maxSuggestions = 3
+
+// FragmentNotFoundError is returned by GetFragmentFromName when the fragment's file does not exist.
+type FragmentNotFoundError struct {
+	Name        string
+	Type        FragmentType
+	Path        string
+	Suggestions []string // Names of existing fragments of the same type, closest first
+	Err         error
+}
+
+func (e *FragmentNotFoundError) Error() string {
+	return withSuggestions(fmt.Sprintf("%s not found: `%s` (no file at %s)", fragmentTypeLabel(e.Type), e.Name, filepath.ToSlash(e.Path)), e.Suggestions)
+}
+
+func (e *FragmentNotFoundError) Unwrap() error {
+	return e.Err
+}
+
+func fragmentTypeLabel(t FragmentType) string {
+	switch t {
+	case PAGE:
+		return "Page"
+	case TEMPLATE:
+		return "Template"
+	}
+	return "Fragment"
+}
+
+// withSuggestions appends a "Did you mean" line to message when there are suggestions.
+func withSuggestions(message string, suggestions []string) string {
+	if len(suggestions) == 0 {
+		return message
+	}
+	quoted := make([]string, len(suggestions))
+	for i, s := range suggestions {
+		quoted[i] = "`" + s + "`"
+	}
+	list := quoted[0]
+	if len(quoted) > 1 {
+		list = strings.Join(quoted[:len(quoted)-1], ", ") + " or " + quoted[len(quoted)-1]
+	}
+	return fmt.Sprintf("%s\nDid you mean %s?", message, list)
+}
+
+// suggestNames returns the candidates closest to name by edit distance, closest first. Candidates
+// that are too different to be a typo of name are left out.
+func suggestNames(name string, candidates []string) []string {
+	type scored struct {
+		name     string
+		distance int
+	}
+
+	limit := len([]rune(name))/3 + 1
+	if limit > 4 {
+		limit = 4
+	}
+
+	seen := make(map[string]bool)
+	var matches []scored
+	for _, c := range candidates {
+		if c == name || seen[c] {
+			continue
+		}
+		seen[c] = true
+		d := levenshtein(strings.ToLower(name), strings.ToLower(c))
+		if d <= limit {
+			matches = append(matches, scored{c, d})
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].distance != matches[j].distance {
+			return matches[i].distance < matches[j].distance
+		}
+		return matches[i].name < matches[j].name
+	})
+
+	var names []string
+	for i := 0; i < len(matches) && i < maxSuggestions; i++ {
+		names = append(names, matches[i].name)
+	}
+	return names
+}
+
+// levenshtein returns the number of single character insertions, deletions and substitutions
+// needed to turn a into b.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, minInt(curr[j-1]+1, prev[j-1]+cost))
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// fragmentNames lists the names of the fragments of the given type that exist on disk.
+func (c *FragmentCache) fragmentNames(fragType FragmentType) []string {
+	dir := filepath.Join(c.Config.SiteRoot, fragmentDir(c.Config, fragType))
+	var names []string
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || filepath.Ext(path) != ".frag" {
+			return nil
+		}
+		if rel, err := filepath.Rel(dir, path); err == nil {
+			names = append(names, strings.TrimSuffix(filepath.ToSlash(rel), ".frag"))
+		}
+		return nil
+	})
+	return names
+}
+
+// metaKeys lists the keys of the given tables, including the dotted paths of nested tables, as
+// candidates for suggestions.
+func metaKeys(tables ...*CoreTable) []string {
+	var keys []string
+	var walk func(t *CoreTable, prefix string, depth int)
+	walk = func(t *CoreTable, prefix string, depth int) {
+		if t == nil || depth > 4 {
+			return
+		}
+		for k, v := range t.v {
+			key := prefix + k
+			keys = append(keys, key)
+			if nested, ok := v.(*CoreTable); ok {
+				walk(nested, key+".", depth+1)
+			}
+		}
+	}
+	for _, t := range tables {
+		walk(t, "", 0)
+	}
+	return keys
+}
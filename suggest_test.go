@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestSuggestions(t *testing.T) {
+	files := map[string]string{
+		"fragment/nav.frag":    "~~~\n<nav>nav</nav>",
+		"fragment/footer.frag": "~~~\n<footer>footer</footer>",
+		"page/index.frag": "this:setSharedMeta { title = \"Home\" }\n" +
+			"this:addBuilders { shout = function(content) return content end }\n" +
+			"~~~\n@{naw}<h1>${titel}</h1>*{shuot[[hi]]}",
+	}
+	_, d := renderPage(t, files, "index")
+	requireError(t, d, "Fragment not found: `naw`")
+	requireError(t, d, "Did you mean `nav`?")
+	requireError(t, d, "Did you mean `title`?")
+	requireError(t, d, "Did you mean `shout`?")
+}
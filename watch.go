@@ -0,0 +1,215 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// RebuildResult describes what a rebuild touched.
+type RebuildResult struct {
+	Full    bool               // The configuration changed and the whole site was rebuilt
+	Pages   []string           // Pages that were rebuilt
+	Removed []string           // Pages whose source was deleted, along with their output
+	Assets  []string           // Include files, relative to the include directory, that were copied or removed
+	Errors  map[string][]error // Errors raised by the rebuilt pages, keyed by page name
+
+	Diagnostics *Diagnostics // Every error and warning raised by the rebuild
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// snapshotFiles records the modification time and size of every file under the given paths.
+// Paths that do not exist are skipped so that they are picked up once they are created.
+func snapshotFiles(paths ...string) map[string]fileStamp {
+	snap := make(map[string]fileStamp)
+	for _, root := range paths {
+		_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			snap[path] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+			return nil
+		})
+	}
+	return snap
+}
+
+// changedFiles returns the sorted paths that were created, modified or deleted between two snapshots.
+func changedFiles(before, after map[string]fileStamp) []string {
+	var changed []string
+	for path, stamp := range after {
+		if old, ok := before[path]; !ok || old != stamp {
+			changed = append(changed, path)
+		}
+	}
+	for path := range before {
+		if _, ok := after[path]; !ok {
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// relativeTo returns path relative to dir in slash form, if path is inside dir.
+func relativeTo(dir, path string) (string, bool) {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+func (s *Site) watchedPaths() []string {
+	return []string{s.ConfigPath, s.FragmentDir(), s.PageDir(), s.IncludeDir()}
+}
+
+// Rebuild brings the build directory up to date after the given files changed. Only the pages that
+// depend on a changed fragment, template or page are evaluated again.
+func (s *Site) Rebuild(changed []string) RebuildResult {
+	s.Diagnostics = NewDiagnostics()
+	result := RebuildResult{Diagnostics: s.Diagnostics}
+	var changes []Dependency
+
+	for _, path := range changed {
+		if filepath.Clean(path) == filepath.Clean(s.ConfigPath) {
+			ns, err := LoadSite(s.ConfigPath)
+			if err != nil {
+				log.Error("Failed to read configuration", "path", s.ConfigPath, "error", err)
+				s.Diagnostics.Report("", SEVERITY_ERROR, err)
+				return result
+			}
+			ns.Jobs = s.Jobs
+			ns.FailFast = s.FailFast
+			*s = *ns
+			return s.Build()
+		}
+	}
+
+	for _, path := range changed {
+		if rel, ok := relativeTo(s.IncludeDir(), path); ok {
+			result.Assets = append(result.Assets, rel)
+			continue
+		}
+		if filepath.Ext(path) != ".frag" {
+			continue
+		}
+		if rel, ok := relativeTo(s.FragmentDir(), path); ok {
+			name := strings.TrimSuffix(rel, ".frag")
+			// Drop the cached evaluation so fragments:getFragment sees the new code
+			s.Cache.Remove(name)
+			changes = append(changes, Dependency{DEP_FRAGMENT, name})
+		} else if rel, ok := relativeTo(s.PageDir(), path); ok {
+			changes = append(changes, Dependency{DEP_PAGE, strings.TrimSuffix(rel, ".frag")})
+		}
+	}
+
+	for _, rel := range result.Assets {
+		src := filepath.Join(s.IncludeDir(), filepath.FromSlash(rel))
+		dst := filepath.Join(s.BuildDir(), filepath.FromSlash(rel))
+		if _, err := os.Stat(src); err != nil {
+			if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+				log.Error("Failed to remove asset", "file", dst, "error", err)
+				s.Diagnostics.Report("", SEVERITY_ERROR, err)
+			}
+			continue
+		}
+		if err := copyFile(src, dst); err != nil {
+			log.Error("Failed to copy asset", "file", src, "error", err)
+			s.Diagnostics.Report("", SEVERITY_ERROR, err)
+		}
+	}
+
+	pageDeps := make(map[string]*DependencySet, len(s.Pages))
+	for name, p := range s.Pages {
+		pageDeps[name] = p.Render.Dependencies
+	}
+	// New pages are not known yet, so add them before working out what they affect
+	for _, c := range changes {
+		if _, ok := pageDeps[c.Name]; c.Kind == DEP_PAGE && !ok {
+			pageDeps[c.Name] = NewDependencySet()
+		}
+	}
+
+	rebuild := make(map[string]*Fragment)
+	for _, name := range AffectedPages(pageDeps, changes) {
+		if _, err := os.Stat(s.PageSourcePath(name)); err != nil {
+			delete(s.Pages, name)
+			if s.manifest != nil {
+				delete(s.manifest.Pages, name)
+			}
+			s.Cache.Remove(name)
+			if err := os.Remove(s.PageOutputPath(name)); err != nil && !os.IsNotExist(err) {
+				log.Error("Failed to remove page", "file", s.PageOutputPath(name), "error", err)
+				s.Diagnostics.Report("", SEVERITY_ERROR, err)
+			}
+			result.Removed = append(result.Removed, name)
+			continue
+		}
+
+		f, err := GetFragmentFromName(name, PAGE, s.Cache)
+		if err != nil {
+			log.Error("Failed to read page", "name", name, "error", err)
+			s.Diagnostics.Report(name, SEVERITY_ERROR, err)
+			continue
+		}
+		s.Pages[name] = f
+		rebuild[name] = f
+		result.Pages = append(result.Pages, name)
+	}
+	var outputs map[string]string
+	result.Errors, outputs = s.buildPages(rebuild)
+
+	// Keep the manifest in step so the next build does not render these pages again
+	if s.manifest != nil {
+		current := s.scanSources()
+		current.carryOver(s.manifest)
+		current.recordPages(rebuild, outputs, result.Errors)
+		s.manifest = current
+		s.saveManifest()
+	}
+
+	s.Diagnostics.PrintSummary()
+	return result
+}
+
+// Watch polls the configuration and the fragment, page and include directories, rebuilding the
+// affected parts of the site whenever something changes. It never returns.
+func (s *Site) Watch(interval time.Duration, onRebuild func(RebuildResult)) {
+	snap := snapshotFiles(s.watchedPaths()...)
+	for {
+		time.Sleep(interval)
+
+		next := snapshotFiles(s.watchedPaths()...)
+		changed := changedFiles(snap, next)
+		snap = next
+		if len(changed) == 0 {
+			continue
+		}
+
+		log.Info("Change detected", "files", len(changed))
+		result := s.Rebuild(changed)
+		if result.Full {
+			// The watched directories may have moved with the configuration
+			snap = snapshotFiles(s.watchedPaths()...)
+		}
+		log.Info("Rebuild finished", "full", result.Full, "pages", len(result.Pages), "removed", len(result.Removed), "assets", len(result.Assets), "errors", result.Diagnostics.Count(SEVERITY_ERROR), "warnings", result.Diagnostics.Count(SEVERITY_WARNING))
+
+		if onRebuild != nil {
+			onRebuild(result)
+		}
+	}
+}